@@ -11,30 +11,114 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// stringList is a flag.Value for flags that can be given
+// more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 type args struct {
 	Target              string
 	DistfilesUnexpanded string
 	Arch                string
 	MirrorsSeparated    string
+	MirrorList          string
+	MirrorProtocols     string
+	MirrorRegions       string
+	ProbeMirrors        bool
+	ProbeTimeout        time.Duration
+	LocalMirrorMode     string
+	LocalPackageDir     string
+	CacheDir            string
+	ConnectTimeout      time.Duration
+	ReadTimeout         time.Duration
+	Timeout             time.Duration
+	CABundle            string
+	ClientCert          string
+	ClientKey           string
+	MirrorHeaders       stringList
+	MaxRate             int64
+	MaxConnsPerHost     int
+	DryRun              bool
+	Bundle              string
+	BundleKeyrings      stringList
+	Listen              string
+	Upstream            string
+	Repositories        stringList
+	Keyrings            stringList
+	TrustedFingerprints stringList
+	TimestampDir        string
+	MaxSetupAge         time.Duration
+	AllowRollback       bool
+	IgnoreMinVersion    bool
 	PackagesSeparated   string
+	IncludeBase         bool
+	ExcludesSeparated   string
+	ProvideExcluded     bool
+	ExtractIncludes     string
+	ExtractExcludes     string
+	ExtractPresets      string
+	ExtractLocales      string
 	FetchOnly           bool
 	KeepDistfiles       bool
+	CheckMirrorDir      string
+	DiffClosure         bool
+	JSON                bool
+	SigningKey          string
+	PackName            string
+	PackVersion         string
+	PackRequires        string
+	PackSdesc           string
+	PackCategory        string
+	PackPostinstall     string
+	PackRepo            string
 	Help                bool
+
+	Command     string
+	CommandArgs []string
+
+	selectedMirrors []string
 }
 
-func (a *args) Distfiles() string {
-	return os.Expand(a.DistfilesUnexpanded, func(key string) string {
+// DistfilesLayers returns the -distfiles directories in the
+// order they are consulted. All but the last are read-only.
+func (a *args) DistfilesLayers() []string {
+	expanded := os.Expand(a.DistfilesUnexpanded, func(key string) string {
 		switch key {
 		case "target":
 			return a.Target
 		}
 		return ""
 	})
+	return filepath.SplitList(expanded)
+}
+
+// Distfiles returns the writable -distfiles directory.
+func (a *args) Distfiles() string {
+	layers := a.DistfilesLayers()
+	if len(layers) == 0 {
+		return ""
+	}
+	return layers[len(layers)-1]
 }
 
+// Mirrors returns the mirrors of the default repository. Once
+// they have been selected via selectMirrors, it returns the
+// selected mirrors, in order of preference.
 func (a *args) Mirrors() []string {
+	if a.selectedMirrors != nil {
+		return a.selectedMirrors
+	}
 	return strings.Split(a.MirrorsSeparated, ",")
 }
 
@@ -42,6 +126,34 @@ func (a *args) Packages() []string {
 	return strings.Split(a.PackagesSeparated, ",")
 }
 
+func (a *args) Excludes() []string {
+	return splitList(a.ExcludesSeparated)
+}
+
+func splitList(separated string) []string {
+	if separated == "" {
+		return []string{}
+	}
+	return strings.Split(separated, ",")
+}
+
+// flagGiven reports whether the flag name was given on the
+// command line, as opposed to left at its default.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+func (a *args) PathFilter() (*pathFilter, error) {
+	includes := append(splitList(a.ExtractIncludes), localeIncludes(splitList(a.ExtractLocales))...)
+	return newPathFilter(includes, splitList(a.ExtractExcludes), splitList(a.ExtractPresets))
+}
+
 var Args args
 
 func defaultDistfiles() string {
@@ -50,14 +162,60 @@ func defaultDistfiles() string {
 
 func init() {
 	flag.StringVar(&Args.Target, "target", "", "target directory for cygwin installation (i.e, c:\\cygwin)")
-	flag.StringVar(&Args.DistfilesUnexpanded, "distfiles", defaultDistfiles(), "path where "+progName+" will store downloaded artifacts")
+	flag.StringVar(&Args.DistfilesUnexpanded, "distfiles", defaultDistfiles(), "path where "+progName+" will store downloaded artifacts; earlier directories in a list of paths are only read from")
 	flag.StringVar(&Args.Arch, "arch", "x86", "cygwin architecture (x86 or x86_64)")
-	flag.StringVar(&Args.MirrorsSeparated, "mirrors", "http://mirrors.dotsrc.org/cygwin", "mirror(s) to download from (comma separated)")
-	flag.StringVar(&Args.PackagesSeparated, "packages", "base-cygwin,cygwin,base-files,bash,patch,tar,xz,gzip,bzip2,hostname,curl,which,unzip,grep,gawk,vim,mingw64-i686-gcc-core,mingw64-i686-binutils,diffutils,diffstat,autoconf", "packages to install (comma separated)")
+	flag.StringVar(&Args.MirrorsSeparated, "mirrors", "http://mirrors.dotsrc.org/cygwin", "mirror(s) to download from: http(s):// or file:// URLs or local directories (comma separated)")
+	flag.StringVar(&Args.MirrorList, "mirror-list", "", "URL or path of a Cygwin mirrors.lst to add mirrors from (i.e, https://cygwin.com/mirrors.lst)")
+	flag.StringVar(&Args.MirrorProtocols, "mirror-protocols", "https,http", "protocols of mirrors to use from -mirror-list (comma separated)")
+	flag.StringVar(&Args.MirrorRegions, "mirror-regions", "", "regions or countries of mirrors to use from -mirror-list (comma separated, default all)")
+	flag.BoolVar(&Args.ProbeMirrors, "probe-mirrors", false, "probe mirrors, skip unreachable ones, and prefer those with the newest setup.ini and the lowest latency")
+	flag.DurationVar(&Args.ProbeTimeout, "probe-timeout", 5*time.Second, "timeout for probing a mirror")
+	flag.StringVar(&Args.LocalMirrorMode, "local-mirror-mode", localMirrorDirect, "how to use files of file:// and local directory mirrors: direct (in place), link (hard link into distfiles) or copy (copy into distfiles)")
+	flag.DurationVar(&Args.ConnectTimeout, "connect-timeout", 30*time.Second, "timeout for connecting to a mirror, including the TLS handshake (0 disables the timeout)")
+	flag.DurationVar(&Args.ReadTimeout, "read-timeout", time.Minute, "timeout for a mirror to respond or to send more data (0 disables the timeout)")
+	flag.DurationVar(&Args.Timeout, "timeout", 0, "timeout for a whole download, including reading the body (0 disables the timeout)")
+	flag.StringVar(&Args.CABundle, "ca-bundle", "", "PEM file with additional CA certificates to trust for https mirrors")
+	flag.StringVar(&Args.ClientCert, "client-cert", "", "PEM file with a TLS client certificate to present to https mirrors")
+	flag.StringVar(&Args.ClientKey, "client-key", "", "PEM file with the key of -client-cert (default: -client-cert)")
+	flag.Var(&Args.MirrorHeaders, "mirror-header", "extra request header for a mirror, as <mirror URL>=<Header>: <value> (repeatable)")
+	flag.Int64Var(&Args.MaxRate, "max-rate", 0, "limit the combined rate of all downloads to this many bytes per second (0 for unlimited)")
+	flag.IntVar(&Args.MaxConnsPerHost, "max-connections-per-host", 0, "maximum number of simultaneous connections to a mirror host (0 for unlimited)")
+	flag.StringVar(&Args.CacheDir, "cache-dir", "", "shared cache of distfiles by SHA-512, safe to use from concurrent runs; distfiles are hard linked or copied from it")
+	flag.BoolVar(&Args.DryRun, "dry-run", false, "only report what the gc command would remove")
+	flag.StringVar(&Args.LocalPackageDir, "local-package-dir", "", "setup.exe local package directory to install the -mirrors repository from instead of -mirrors, without network access")
+	flag.StringVar(&Args.Bundle, "bundle", "", "bundle to install from instead of the mirrors of all repositories, without network access")
+	flag.Var(&Args.BundleKeyrings, "bundle-keyring", "armored or binary OpenPGP keyring to verify -bundle manifests with (repeatable; default: the keys trusted for the -mirrors repository)")
+	flag.StringVar(&Args.Listen, "listen", ":8080", "address for the serve command to listen on")
+	flag.StringVar(&Args.Upstream, "upstream", "", "mirror for the serve command to fetch and cache misses from")
+	flag.Var(&Args.Repositories, "repo", "additional repository, as name=<name>,url=<url>,key=<public key file>[,fingerprint=<fp>][,priority=<n>] (repeatable; url, key and fingerprint are repeatable; the -mirrors repository has priority 0)")
+	flag.Var(&Args.Keyrings, "keyring", "armored or binary OpenPGP keyring to trust for the -mirrors repository instead of the built-in Cygwin key (repeatable)")
+	flag.Var(&Args.TrustedFingerprints, "trusted-fingerprint", "only accept setup.ini signatures of the -mirrors repository made by the key with this fingerprint (repeatable)")
+	flag.StringVar(&Args.TimestampDir, "timestamp-dir", "", "directory to record the newest accepted setup.ini timestamps in (default: in -cache-dir if given, otherwise in the per-user configuration directory)")
+	flag.DurationVar(&Args.MaxSetupAge, "max-setup-age", 0, "refuse setup.ini files older than this (i.e, 720h; 0 disables the check)")
+	flag.BoolVar(&Args.AllowRollback, "allow-rollback", false, "accept setup.ini files older than previously accepted or than -max-setup-age, for pinned snapshots")
+	flag.BoolVar(&Args.IgnoreMinVersion, "ignore-minimum-version", false, "use setup.ini files whose setup-minimum-version is newer than supported")
+	flag.StringVar(&Args.PackagesSeparated, "packages", "base-cygwin,cygwin,base-files,bash,patch,tar,xz,gzip,bzip2,hostname,curl,which,unzip,grep,gawk,vim,mingw64-i686-gcc-core,mingw64-i686-binutils,diffutils,diffstat,autoconf", "packages to install (comma separated, @Category selects a whole category)")
+	flag.BoolVar(&Args.IncludeBase, "include-base", false, "also install every package in the Base category, like setup.exe does")
+	flag.StringVar(&Args.ExcludesSeparated, "exclude", "", "packages to drop from the set of packages to install, including dependencies (comma separated glob patterns)")
+	flag.BoolVar(&Args.ProvideExcluded, "provide-excluded", false, "record excluded packages as provided externally in the package database")
+	flag.StringVar(&Args.ExtractIncludes, "extract-include", "", "paths to extract even if excluded by -extract-exclude or -extract-preset (comma separated glob patterns)")
+	flag.StringVar(&Args.ExtractExcludes, "extract-exclude", "", "paths to skip when extracting packages (comma separated glob patterns)")
+	flag.StringVar(&Args.ExtractPresets, "extract-preset", "", "predefined sets of paths to skip when extracting packages, comma separated: nodocs, nolocale (all locales not kept via -extract-locales)")
+	flag.StringVar(&Args.ExtractLocales, "extract-locales", "", "locales to extract even if excluded by -extract-preset nolocale (comma separated glob patterns, e.g. de,pt_*)")
 	flag.BoolVar(&Args.FetchOnly, "fetch-only", false, "only fetch distfiles, don't install anything (implies -keep-distfiles=true)")
 	flag.BoolVar(&Args.KeepDistfiles, "keep-distfiles", false, "keep distfiles?")
+	flag.StringVar(&Args.CheckMirrorDir, "check-mirror-dir", "", "local mirror directory to look for archives in (check command)")
+	flag.BoolVar(&Args.DiffClosure, "diff-closure", false, "only show changes affecting -packages and their dependencies (diff command)")
+	flag.BoolVar(&Args.JSON, "json", false, "print output as JSON (diff command)")
+	flag.StringVar(&Args.SigningKey, "signing-key", "", "armored OpenPGP private key to sign setup.ini with (mirror and pack commands, passphrase via "+signingKeyPassphraseEnv+")")
+	flag.StringVar(&Args.PackName, "pack-name", "", "name of the package to create (pack command)")
+	flag.StringVar(&Args.PackVersion, "pack-version", "", "version-release of the package to create (pack command)")
+	flag.StringVar(&Args.PackRequires, "pack-requires", "", "dependencies of the package to create (pack command, comma separated)")
+	flag.StringVar(&Args.PackSdesc, "pack-sdesc", "", "short description of the package to create (pack command)")
+	flag.StringVar(&Args.PackCategory, "pack-category", "", "categories of the package to create (pack command, comma separated)")
+	flag.StringVar(&Args.PackPostinstall, "pack-postinstall", "", "postinstall script to add to the package as etc/postinstall/<name>.sh (pack command)")
+	flag.StringVar(&Args.PackRepo, "pack-repo", "", "local repository directory to add the package to (pack command)")
 	flag.BoolVar(&Args.Help, "help", false, "show this listing")
-	flag.Parse()
 }
 
 func ParseArgs() error {
@@ -65,18 +223,65 @@ func ParseArgs() error {
 
 	if Args.Help {
 		fmt.Fprintf(os.Stderr, "%v v%v\n\n", progName, progVersion)
+		fmt.Fprintf(os.Stderr, "usage: %v [flags] [command [args...]]\n\n", progName)
+		printCommands(os.Stderr)
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
 
-	if !Args.FetchOnly && Args.Target == "" {
+	if flag.NArg() > 0 {
+		Args.Command = flag.Arg(0)
+		Args.CommandArgs = flag.Args()[1:]
+		if _, ok := commands[Args.Command]; !ok {
+			return fmt.Errorf("unknown command: %v", Args.Command)
+		}
+	}
+
+	if Args.Command == "" && !Args.FetchOnly && Args.Target == "" {
 		return fmt.Errorf("missing argument: target")
 	}
 
+	if len(Args.DistfilesLayers()) == 0 {
+		return fmt.Errorf("missing argument: distfiles")
+	}
+
 	if Args.Arch != "x86" && Args.Arch != "x86_64" {
 		return fmt.Errorf("invalid argument: arch is '%v' -- unknown arch!", Args.Arch)
 	}
 
+	for _, spec := range Args.MirrorHeaders {
+		if _, err := parseMirrorHeader(spec); err != nil {
+			return fmt.Errorf("invalid argument: %v", err)
+		}
+	}
+
+	if Args.ClientKey != "" && Args.ClientCert == "" {
+		return fmt.Errorf("invalid arguments: client-key requires client-cert")
+	}
+
+	if Args.MaxRate < 0 || Args.MaxConnsPerHost < 0 {
+		return fmt.Errorf("invalid arguments: max-rate and max-connections-per-host can't be negative")
+	}
+
+	if _, err := newHTTPTransport(); err != nil {
+		return fmt.Errorf("invalid argument: %v", err)
+	}
+
+	if Args.Bundle != "" && Args.LocalPackageDir != "" {
+		return fmt.Errorf("invalid arguments: bundle and local-package-dir can't be used together")
+	}
+
+	switch Args.LocalMirrorMode {
+	case localMirrorDirect, localMirrorLink, localMirrorCopy:
+	default:
+		return fmt.Errorf("invalid argument: local-mirror-mode is '%v' -- unknown mode!", Args.LocalMirrorMode)
+	}
+
+	if _, err := Args.PathFilter(); err != nil {
+		return fmt.Errorf("invalid argument: %v", err)
+	}
+
 	if Args.FetchOnly {
 		Args.KeepDistfiles = true
 	}
@@ -0,0 +1,407 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A bundle is a single uncompressed tar file that contains the
+// setup.ini of each repository with its signature, the archives
+// of a set of packages, and a signed manifest of all of them.
+//
+// Bundle members use the same layout as the distfiles directory.
+// The manifest comes first, so that a bundle can be checked
+// before any of its other members are used.
+const (
+	bundleManifestName    = "MANIFEST"
+	bundleManifestSigName = "MANIFEST.sig"
+)
+
+// bundleMirrorPrefix marks the mirror that stands in for a
+// repository's mirrors when installing from -bundle.
+const bundleMirrorPrefix = "bundle://"
+
+// bundleEntry is a member of an opened bundle.
+type bundleEntry struct {
+	Offset int64
+	Size   int64
+	SHA512 string
+}
+
+// bundle is an opened bundle, with an index of the offsets of
+// its members.
+type bundle struct {
+	f       *os.File
+	entries map[string]bundleEntry
+}
+
+// activeBundle is the bundle given via -bundle, once opened.
+var activeBundle *bundle
+
+// isBundleMirror reports whether mirror is the mirror of the
+// opened -bundle.
+func isBundleMirror(mirror string) bool {
+	return strings.HasPrefix(mirror, bundleMirrorPrefix)
+}
+
+// writeBundleMember writes the file at absFn to tw as name.
+func writeBundleMember(tw *tar.Writer, absFn string, name string) error {
+	fi, err := os.Stat(absFn)
+	if err != nil {
+		return err
+	}
+	return addFileToTar(tw, absFn, name, fi)
+}
+
+// writeBundle writes the files in members, mapping bundle member
+// names to their paths, to a bundle at outFn, along with a
+// manifest signed by signer.
+func writeBundle(outFn string, members map[string]string, signer *openpgp.Entity) error {
+	names := []string{}
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var manifest bytes.Buffer
+	for _, name := range names {
+		size, sum, err := fileSHA512(members[name])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "%v %v %v\n", sum, size, name)
+	}
+
+	var sig bytes.Buffer
+	err := openpgp.DetachSign(&sig, signer, bytes.NewReader(manifest.Bytes()), nil)
+	if err != nil {
+		return err
+	}
+
+	err = ensureParentDirExists(outFn)
+	if err != nil {
+		return err
+	}
+
+	partFn := outFn + ".part"
+	f, err := os.Create(partFn)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(f)
+	now := time.Now()
+	for _, content := range []struct {
+		name string
+		data []byte
+	}{
+		{bundleManifestName, manifest.Bytes()},
+		{bundleManifestSigName, sig.Bytes()},
+	} {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    content.name,
+			Mode:    0644,
+			Size:    int64(len(content.data)),
+			ModTime: now,
+		})
+		if err == nil {
+			_, err = tw.Write(content.data)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	for _, name := range names {
+		err = writeBundleMember(tw, members[name], name)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(partFn, outFn)
+}
+
+// openBundle opens the bundle at path, indexes its members and
+// verifies its manifest against the keys trusted for repo. Every
+// member other than the manifest itself must be listed in the
+// manifest with its size.
+func openBundle(path string, repo *Repository) (*bundle, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bundle{f: f, entries: make(map[string]bundleEntry)}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		// The tar reader seeks past member data, so the
+		// current offset is where the data starts.
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		b.entries[hdr.Name] = bundleEntry{Offset: offset, Size: hdr.Size}
+	}
+
+	err = b.verifyManifest(repo)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// section returns a reader for the data of the member entry.
+func (b *bundle) section(entry bundleEntry) *io.SectionReader {
+	return io.NewSectionReader(b.f, entry.Offset, entry.Size)
+}
+
+func (b *bundle) verifyManifest(repo *Repository) error {
+	manifestEntry, ok := b.entries[bundleManifestName]
+	if !ok {
+		return fmt.Errorf("bundle has no %v", bundleManifestName)
+	}
+	sigEntry, ok := b.entries[bundleManifestSigName]
+	if !ok {
+		return fmt.Errorf("bundle has no %v", bundleManifestSigName)
+	}
+
+	sig := make([]byte, sigEntry.Size)
+	_, err := io.ReadFull(b.section(sigEntry), sig)
+	if err != nil {
+		return err
+	}
+
+	signer, err := verifySignature(repo, b.section(manifestEntry), sig)
+	if err != nil {
+		return fmt.Errorf("unable to verify bundle manifest: %v", err)
+	}
+	log.Printf("bundle manifest signed by %v (fingerprint %v)", signerIdentity(signer), fingerprintString(signer.PrimaryKey))
+
+	listed := make(map[string]bool)
+	scanner := bufio.NewScanner(b.section(manifestEntry))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("malformed bundle manifest line: %v", scanner.Text())
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed bundle manifest line: %v", scanner.Text())
+		}
+		name := fields[2]
+		entry, ok := b.entries[name]
+		if !ok {
+			return fmt.Errorf("bundle is missing '%v'", name)
+		}
+		if entry.Size != size {
+			return fmt.Errorf("size mismatch for '%v' in bundle. Has %v, want %v", name, entry.Size, size)
+		}
+		entry.SHA512 = fields[0]
+		b.entries[name] = entry
+		listed[name] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for name := range b.entries {
+		if name != bundleManifestName && name != bundleManifestSigName && !listed[name] {
+			return fmt.Errorf("'%v' in bundle is not in the manifest", name)
+		}
+	}
+
+	return nil
+}
+
+// Fetch copies the member name of the bundle to outFn, and
+// verifies it against the manifest.
+func (b *bundle) Fetch(name string, outFn string) error {
+	entry, ok := b.entries[name]
+	if !ok || entry.SHA512 == "" {
+		return fmt.Errorf("'%v' is not in the bundle", name)
+	}
+
+	err := ensureParentDirExists(outFn)
+	if err != nil {
+		return err
+	}
+
+	partFn := outFn + ".part"
+	out, err := os.Create(partFn)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, b.section(entry))
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	err = checkSHA512(partFn, entry.Size, entry.SHA512)
+	if err != nil {
+		os.Remove(partFn)
+		return err
+	}
+
+	return os.Rename(partFn, outFn)
+}
+
+// bundleTrust returns a pseudo repository holding the keys that
+// bundle manifests are verified against: -bundle-keyring, or the
+// keys trusted for the default repository of repos if none is
+// given.
+func bundleTrust(repos []*Repository) (*Repository, error) {
+	trust := &Repository{Name: "bundle"}
+	for _, repo := range repos {
+		if repo.Name == defaultRepositoryName {
+			trust.Keyring = repo.Keyring
+			trust.Fingerprints = repo.Fingerprints
+		}
+	}
+	if len(Args.BundleKeyrings) > 0 {
+		trust.Keyring = openpgp.EntityList{}
+		trust.Fingerprints = nil
+		for _, keyFile := range Args.BundleKeyrings {
+			keys, err := readKeyringFile(keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read keyring '%v': %v", keyFile, err)
+			}
+			trust.Keyring = append(trust.Keyring, keys...)
+		}
+	}
+	return trust, nil
+}
+
+// useBundle opens the bundle given via -bundle, and makes all of
+// repos use it instead of their mirrors.
+func useBundle(repos []*Repository) error {
+	trust, err := bundleTrust(repos)
+	if err != nil {
+		return err
+	}
+
+	b, err := openBundle(Args.Bundle, trust)
+	if err != nil {
+		return err
+	}
+	activeBundle = b
+
+	for _, repo := range repos {
+		repo.Mirrors = []string{bundleMirrorPrefix + repo.Name}
+	}
+	return nil
+}
+
+func runBundle(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one output file argument, got %v", len(args))
+	}
+	outFn := args[0]
+
+	if Args.SigningKey == "" {
+		return fmt.Errorf("missing argument: signing-key")
+	}
+
+	signer, err := readSigningKey(Args.SigningKey)
+	if err != nil {
+		return fmt.Errorf("unable to read signing key: %v", err)
+	}
+
+	dist, err := loadDistribution()
+	if err != nil {
+		return err
+	}
+
+	pkgs, err := requestedPackages(dist)
+	if err != nil {
+		return err
+	}
+
+	closure, missing := resolveClosure(dist, pkgs, Args.Excludes())
+	if len(missing) > 0 {
+		return fmt.Errorf("no such packages: %v", strings.Join(missing, ", "))
+	}
+
+	members := make(map[string]string)
+	for _, repo := range dist.Repositories {
+		for _, relativeUrl := range []string{Args.Arch + "/" + repo.setupIniVariant, Args.Arch + "/" + repo.setupIniVariant + ".sig"} {
+			members[repo.DistfileName(relativeUrl)] = repo.FilePath(relativeUrl)
+		}
+	}
+
+	for _, name := range closure {
+		pkg, err := dist.Get(name)
+		if err != nil {
+			return err
+		}
+
+		relativeUrl, fileSize, sha512sum := pkg.InstallInfo()
+		if relativeUrl == "" {
+			continue
+		}
+
+		log.Printf("bundling package '%v'", name)
+		err = ensureDownloaded(pkg.Repo, relativeUrl, fileSize, sha512sum)
+		if err != nil {
+			return err
+		}
+		members[pkg.Repo.DistfileName(relativeUrl)] = pkg.Repo.FilePath(relativeUrl)
+	}
+
+	log.Printf("writing bundle '%v' with %v packages", outFn, len(closure))
+	err = writeBundle(outFn, members, signer)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("done")
+	return nil
+}
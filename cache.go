@@ -0,0 +1,239 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// cacheLockPollInterval is how often a run waiting for
+	// another run's download into the cache checks whether
+	// it is done.
+	cacheLockPollInterval = 500 * time.Millisecond
+	// cacheLockStaleAge is the age after which a lock in the
+	// cache is assumed to belong to a run that died.
+	cacheLockStaleAge = 30 * time.Minute
+	// cacheLockRefreshInterval is how often the holder of a
+	// lock touches it, so that it never becomes stale while
+	// the download is running, however slow it is.
+	cacheLockRefreshInterval = cacheLockStaleAge / 6
+)
+
+// cacheEntriesDir returns the directory of the -cache-dir cache
+// that holds its entries.
+func cacheEntriesDir() string {
+	return filepath.Join(Args.CacheDir, "sha512")
+}
+
+// cachePath returns the path of the file with the SHA-512 sum
+// sha512sum in the -cache-dir cache.
+func cachePath(sha512sum string) string {
+	return filepath.Join(cacheEntriesDir(), sha512sum[:2], sha512sum)
+}
+
+// newCacheLockToken returns the contents of a new lock: the
+// process id, for people looking at the lock, and a random
+// token that identifies the holder.
+func newCacheLockToken() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v %v\n", os.Getpid(), hex.EncodeToString(buf)), nil
+}
+
+// cacheLockHeldBy reports whether the lock at lockFn contains
+// token.
+func cacheLockHeldBy(lockFn string, token string) bool {
+	buf, err := ioutil.ReadFile(lockFn)
+	return err == nil && string(buf) == token
+}
+
+// lockCacheEntry locks the cache entry at path against other
+// processes, waiting for them if necessary, and returns a
+// function that releases the lock. The lock is touched every
+// cacheLockRefreshInterval until it is released.
+func lockCacheEntry(path string) (func(), error) {
+	err := ensureParentDirExists(path)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := newCacheLockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	lockFn := path + ".lock"
+	waiting := false
+	for {
+		f, err := os.OpenFile(lockFn, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.WriteString(token)
+			if err == nil {
+				err = f.Close()
+			} else {
+				f.Close()
+			}
+			if err != nil {
+				os.Remove(lockFn)
+				return nil, err
+			}
+			return holdCacheLock(lockFn, token), nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if fi, err := os.Stat(lockFn); err == nil && time.Since(fi.ModTime()) > cacheLockStaleAge {
+			if staleToken, err := ioutil.ReadFile(lockFn); err == nil {
+				breakStaleCacheLock(lockFn, string(staleToken))
+			}
+			continue
+		}
+
+		if !waiting {
+			log.Printf("waiting for another download of '%v'", path)
+			waiting = true
+		}
+		time.Sleep(cacheLockPollInterval)
+	}
+}
+
+// holdCacheLock touches the lock at lockFn, holding token,
+// periodically, and returns a function that stops doing so and
+// removes the lock. A lock that no longer holds token belongs
+// to someone else, and is left alone.
+func holdCacheLock(lockFn string, token string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(cacheLockRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !cacheLockHeldBy(lockFn, token) {
+					log.Printf("lost cache lock '%v'", lockFn)
+					return
+				}
+				now := time.Now()
+				err := os.Chtimes(lockFn, now, now)
+				if err != nil {
+					log.Printf("unable to refresh cache lock '%v': %v", lockFn, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if cacheLockHeldBy(lockFn, token) {
+			os.Remove(lockFn)
+		}
+	}
+}
+
+// breakStaleCacheLock removes the lock at lockFn, which was
+// found to be stale while holding staleToken. The lock is
+// first renamed to a name of its own, which only one of several
+// processes breaking it at the same time can do. If the renamed
+// lock turns out not to hold staleToken, it is a live lock that
+// replaced the stale one in the meantime, and is put back.
+func breakStaleCacheLock(lockFn string, staleToken string) {
+	brokenFn := fmt.Sprintf("%v.stale.%v.%v", lockFn, os.Getpid(), time.Now().UnixNano())
+	if os.Rename(lockFn, brokenFn) != nil {
+		// Broken or released by someone else.
+		return
+	}
+	defer os.Remove(brokenFn)
+
+	if !cacheLockHeldBy(brokenFn, staleToken) {
+		// Linking fails if yet another process has locked
+		// since; the holder of the live lock notices that
+		// it lost it, and leaves the new lock alone.
+		os.Link(brokenFn, lockFn)
+		return
+	}
+
+	log.Printf("removed stale cache lock '%v'", lockFn)
+}
+
+// useCachedFile populates outFn from the cache entry at cached
+// if that entry exists and matches fileSize and sha512sum, and
+// reports whether it did.
+func useCachedFile(cached string, outFn string, fileSize int64, sha512sum string) bool {
+	if checkSHA512(cached, fileSize, sha512sum) != nil {
+		return false
+	}
+	err := linkOrCopy(cached, outFn)
+	if err != nil {
+		log.Printf("unable to use cached '%v': %v", cached, err)
+		return false
+	}
+	return true
+}
+
+// ensureDownloadedViaCache is like ensureDownloaded, but takes
+// the distfile from the -cache-dir cache if it is there, and
+// adds it to the cache otherwise.
+func ensureDownloadedViaCache(repo *Repository, mirrorRelativeURL string, fileSize int64, sha512sum string) error {
+	if !isSHA512Hex(sha512sum) {
+		return fmt.Errorf("malformed SHA-512 sum for '%v': %v", mirrorRelativeURL, sha512sum)
+	}
+
+	cached := cachePath(sha512sum)
+	outFn := repo.DistfilePath(mirrorRelativeURL)
+
+	if useCachedFile(cached, outFn, fileSize, sha512sum) {
+		repo.setFilePath(mirrorRelativeURL, outFn)
+		return nil
+	}
+
+	unlock, err := lockCacheEntry(cached)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	// Another process may have added the file while
+	// we were waiting for the lock.
+	if useCachedFile(cached, outFn, fileSize, sha512sum) {
+		repo.setFilePath(mirrorRelativeURL, outFn)
+		return nil
+	}
+
+	_, err = downloadFromMirrors(repo, repo.PreferredMirrors(), mirrorRelativeURL, fileSize, sha512sum)
+	if err != nil {
+		return err
+	}
+
+	partFn := cached + ".part"
+	err = linkOrCopy(repo.FilePath(mirrorRelativeURL), partFn)
+	if err == nil {
+		err = os.Rename(partFn, cached)
+	}
+	if err != nil {
+		// The download itself succeeded, so failing to
+		// cache it is not fatal.
+		log.Printf("unable to add '%v' to the cache: %v", mirrorRelativeURL, err)
+		os.Remove(partFn)
+	}
+
+	return nil
+}
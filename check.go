@@ -0,0 +1,235 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sha512HexLen is the length of a hex-encoded SHA-512 sum,
+// as found in the install and source fields of setup.ini.
+const sha512HexLen = 128
+
+// isSHA512Hex reports whether s is a hex-encoded SHA-512 sum.
+func isSHA512Hex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == sha512HexLen
+}
+
+// setupIniSections are the section prefixes under which
+// setup.ini can list alternative versions of a package.
+var setupIniSections = []string{"", "prev", "test"}
+
+type checkProblem struct {
+	Severity string
+	Package  string
+	Message  string
+}
+
+type checkReport struct {
+	Problems []checkProblem
+}
+
+func (r *checkReport) Errorf(pkg string, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, checkProblem{"error", pkg, fmt.Sprintf(format, args...)})
+}
+
+func (r *checkReport) Warnf(pkg string, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, checkProblem{"warning", pkg, fmt.Sprintf(format, args...)})
+}
+
+func (r *checkReport) NumErrors() int {
+	n := 0
+	for _, problem := range r.Problems {
+		if problem.Severity == "error" {
+			n++
+		}
+	}
+	return n
+}
+
+// checkArchiveField checks an install or source field of a
+// package. It returns the relative URL of the archive, or ""
+// if the field is malformed.
+func checkArchiveField(report *checkReport, name string, key string, val interface{}) string {
+	info, ok := val.([]string)
+	if !ok || len(info) != 3 {
+		report.Errorf(name, "malformed %v field: %v", key, val)
+		return ""
+	}
+	if info[0] == "" {
+		report.Errorf(name, "%v field has an empty path", key)
+		return ""
+	}
+	size, err := strconv.ParseInt(info[1], 10, 64)
+	if err != nil || size < 0 {
+		report.Errorf(name, "%v field has malformed size '%v'", key, info[1])
+	}
+	if !isSHA512Hex(info[2]) {
+		report.Errorf(name, "%v field has malformed SHA-512 sum '%v'", key, info[2])
+	}
+	return info[0]
+}
+
+// findCycles returns the dependency cycles in dist, as the
+// sorted names of the packages that make up each cycle.
+func findCycles(dist *Distribution) [][]string {
+	// Tarjan's strongly connected components algorithm.
+	index := make(map[string]int)
+	lowlink := make(map[string]int)
+	onStack := make(map[string]bool)
+	stack := []string{}
+	cycles := [][]string{}
+	next := 0
+
+	var visit func(name string)
+	visit = func(name string) {
+		index[name] = next
+		lowlink[name] = next
+		next++
+		stack = append(stack, name)
+		onStack[name] = true
+
+		selfLoop := false
+		pkg, err := dist.Get(name)
+		if err == nil {
+			for _, req := range pkg.Requirements() {
+				if req == name {
+					selfLoop = true
+				}
+				if _, err := dist.Get(req); err != nil {
+					continue
+				}
+				if _, ok := index[req]; !ok {
+					visit(req)
+					if lowlink[req] < lowlink[name] {
+						lowlink[name] = lowlink[req]
+					}
+				} else if onStack[req] && index[req] < lowlink[name] {
+					lowlink[name] = index[req]
+				}
+			}
+		}
+
+		if lowlink[name] == index[name] {
+			component := []string{}
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component = append(component, top)
+				if top == name {
+					break
+				}
+			}
+			if len(component) > 1 || selfLoop {
+				sort.Strings(component)
+				cycles = append(cycles, component)
+			}
+		}
+	}
+
+	for _, pkg := range dist.Packages {
+		if _, ok := index[pkg.Name()]; !ok {
+			visit(pkg.Name())
+		}
+	}
+
+	return cycles
+}
+
+// checkDistribution checks dist for consistency problems. If
+// mirrorDir is not empty, it also checks that every archive
+// referenced by dist exists below mirrorDir.
+func checkDistribution(dist *Distribution, mirrorDir string) *checkReport {
+	report := &checkReport{}
+
+	seen := make(map[string]int)
+	for _, pkg := range dist.Packages {
+		seen[pkg.Name()]++
+	}
+
+	for _, pkg := range dist.Packages {
+		name := pkg.Name()
+		if name == "__root__" {
+			continue
+		}
+
+		if seen[name] > 1 {
+			report.Errorf(name, "duplicate package stanza (%v stanzas)", seen[name])
+			// Only report the duplicate once.
+			seen[name] = 1
+		}
+
+		for _, req := range pkg.Requirements() {
+			if strings.HasPrefix(req, "_") {
+				// Skip internal hint
+				continue
+			}
+			if _, err := dist.Get(req); err != nil {
+				report.Errorf(name, "requires non-existent package '%v'", req)
+			}
+		}
+
+		if _, ok := pkg.Meta["install"]; !ok {
+			report.Errorf(name, "no install archive")
+		}
+
+		for _, section := range setupIniSections {
+			for _, field := range []string{"install", "source"} {
+				key := section + field
+				val, ok := pkg.Meta[key]
+				if !ok {
+					continue
+				}
+				relativeUrl := checkArchiveField(report, name, key, val)
+				if relativeUrl == "" || mirrorDir == "" {
+					continue
+				}
+				absFn := filepath.Join(mirrorDir, filepath.FromSlash(relativeUrl))
+				if _, err := os.Stat(absFn); os.IsNotExist(err) {
+					report.Errorf(name, "%v archive '%v' is missing from mirror", key, relativeUrl)
+				} else if err != nil {
+					report.Errorf(name, "unable to stat %v archive '%v': %v", key, relativeUrl, err)
+				}
+			}
+		}
+	}
+
+	for _, cycle := range findCycles(dist) {
+		report.Warnf(cycle[0], "dependency cycle: %v", strings.Join(cycle, ", "))
+	}
+
+	return report
+}
+
+func runCheck(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one setup.ini argument, got %v", len(args))
+	}
+
+	dist, err := parseSetupIniFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	report := checkDistribution(dist, Args.CheckMirrorDir)
+	for _, problem := range report.Problems {
+		fmt.Printf("%v: %v: %v\n", problem.Severity, problem.Package, problem.Message)
+	}
+
+	if n := report.NumErrors(); n > 0 {
+		return fmt.Errorf("found %v problems in %v", n, args[0])
+	}
+
+	return nil
+}
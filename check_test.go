@@ -0,0 +1,75 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const checkSum = "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e"
+
+const checkSetupIni = `release: cygwin
+arch: x86
+setup-timestamp: 1792372447
+
+@ a
+version: 1.0-1
+install: x86/release/a/a-1.0-1.tar.xz 0 ` + checkSum + `
+requires: b
+
+@ b
+version: 1.0-1
+install: x86/release/b/b-1.0-1.tar.xz 0 ` + checkSum + `
+requires: c
+
+@ c
+version: 1.0-1
+install: x86/release/c/c-1.0-1.tar.xz 0 ` + checkSum + `
+requires: a missing
+
+@ selfish
+version: 1.0-1
+install: x86/release/selfish/selfish-1.0-1.tar.xz 0 ` + checkSum + `
+requires: selfish
+
+@ standalone
+version: 1.0-1
+install: x86/release/standalone/standalone-1.0-1.tar.xz 0 ` + checkSum + `
+requires: a _windows
+`
+
+func TestFindCycles(t *testing.T) {
+	dist := parseSetupIniString(t, checkSetupIni)
+
+	cycles := findCycles(dist)
+	want := [][]string{{"a", "b", "c"}, {"selfish"}}
+	if !reflect.DeepEqual(cycles, want) {
+		t.Errorf("got %v, want %v", cycles, want)
+	}
+}
+
+func TestCheckDistribution(t *testing.T) {
+	dist := parseSetupIniString(t, checkSetupIni)
+
+	report := checkDistribution(dist, "")
+	problems := []string{}
+	for _, problem := range report.Problems {
+		problems = append(problems, problem.Severity+" "+problem.Package+": "+problem.Message)
+	}
+	want := []string{
+		"error c: requires non-existent package 'missing'",
+		"warning a: dependency cycle: a, b, c",
+		"warning selfish: dependency cycle: selfish",
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("got:\n%v\nwant:\n%v", strings.Join(problems, "\n"), strings.Join(want, "\n"))
+	}
+	if report.NumErrors() != 1 {
+		t.Errorf("got %v errors, want 1", report.NumErrors())
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// command is a sub-command of cygwin-bootstrap.
+//
+// Commands are given as the first non-flag argument, after
+// all flags. Without a command, cygwin-bootstrap bootstraps
+// a Cygwin installation into -target.
+type command struct {
+	Usage       string
+	Description string
+	Run         func(args []string) error
+}
+
+var commands = map[string]*command{
+	"bundle": {
+		Usage:       "bundle <file>",
+		Description: "write a signed offline bundle containing setup.ini and -packages and their dependencies, for use with -bundle",
+		Run:         runBundle,
+	},
+	"check": {
+		Usage:       "check <setup.ini>",
+		Description: "check a setup.ini for consistency problems",
+		Run:         runCheck,
+	},
+	"diff": {
+		Usage:       "diff <old setup.ini> <new setup.ini>",
+		Description: "show the changes between two setup.ini snapshots",
+		Run:         runDiff,
+	},
+	"gc": {
+		Usage:       "gc <setup.ini|installed.db>...",
+		Description: "remove archives in -distfiles and -cache-dir that none of the given setup.ini and installed.db files reference",
+		Run:         runGC,
+	},
+	"mirror": {
+		Usage:       "mirror <directory>",
+		Description: "build a signed partial mirror containing -packages and their dependencies",
+		Run:         runMirror,
+	},
+	"pack": {
+		Usage:       "pack <directory>",
+		Description: "package a directory as -pack-name and add it to the local repository in -pack-repo",
+		Run:         runPack,
+	},
+	"serve": {
+		Usage:       "serve <distfiles directory or bundle>",
+		Description: "serve a distfiles directory or bundle as a mirror over HTTP on -listen",
+		Run:         runServe,
+	},
+	"verify-distfiles": {
+		Usage:       "verify-distfiles [<distfiles directory>]",
+		Description: "verify the setup.ini signatures and archives in a distfiles directory, and that it holds -packages and their dependencies",
+		Run:         runVerifyDistfiles,
+	},
+}
+
+func printCommands(w io.Writer) {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "Commands:\n")
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(w, "  %v\n    \t%v\n", cmd.Usage, cmd.Description)
+	}
+}
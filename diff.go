@@ -0,0 +1,202 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+type diffPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type diffVersionChange struct {
+	Name       string `json:"name"`
+	OldVersion string `json:"old_version"`
+	NewVersion string `json:"new_version"`
+}
+
+type diffDependencyChange struct {
+	Name    string   `json:"name"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// setupIniDiff describes the changes between two setup.ini
+// snapshots.
+type setupIniDiff struct {
+	Added             []diffPackage          `json:"added"`
+	Removed           []diffPackage          `json:"removed"`
+	Upgraded          []diffVersionChange    `json:"upgraded"`
+	Downgraded        []diffVersionChange    `json:"downgraded"`
+	DependencyChanges []diffDependencyChange `json:"dependency_changes"`
+}
+
+// stringSetDifference returns the sorted elements of a that
+// are not in b.
+func stringSetDifference(a []string, b []string) []string {
+	inB := make(map[string]bool)
+	for _, s := range b {
+		inB[s] = true
+	}
+	diff := []string{}
+	for _, s := range a {
+		if !inB[s] {
+			diff = append(diff, s)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// diffDistributions computes the changes from oldDist to
+// newDist. If only is not nil, only changes to the packages
+// in it are reported.
+func diffDistributions(oldDist *Distribution, newDist *Distribution, only map[string]bool) *setupIniDiff {
+	diff := &setupIniDiff{
+		Added:             []diffPackage{},
+		Removed:           []diffPackage{},
+		Upgraded:          []diffVersionChange{},
+		Downgraded:        []diffVersionChange{},
+		DependencyChanges: []diffDependencyChange{},
+	}
+
+	names := make(map[string]bool)
+	for _, pkg := range oldDist.Packages {
+		names[pkg.Name()] = true
+	}
+	for _, pkg := range newDist.Packages {
+		names[pkg.Name()] = true
+	}
+	delete(names, "__root__")
+
+	sorted := []string{}
+	for name := range names {
+		if only == nil || only[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		oldPkg, oldErr := oldDist.Get(name)
+		newPkg, newErr := newDist.Get(name)
+
+		if oldErr != nil {
+			diff.Added = append(diff.Added, diffPackage{name, newPkg.Version()})
+			continue
+		}
+		if newErr != nil {
+			diff.Removed = append(diff.Removed, diffPackage{name, oldPkg.Version()})
+			continue
+		}
+
+		change := diffVersionChange{name, oldPkg.Version(), newPkg.Version()}
+		switch compareVersions(change.OldVersion, change.NewVersion) {
+		case -1:
+			diff.Upgraded = append(diff.Upgraded, change)
+		case 1:
+			diff.Downgraded = append(diff.Downgraded, change)
+		}
+
+		added := stringSetDifference(newPkg.Requirements(), oldPkg.Requirements())
+		removed := stringSetDifference(oldPkg.Requirements(), newPkg.Requirements())
+		if len(added) > 0 || len(removed) > 0 {
+			diff.DependencyChanges = append(diff.DependencyChanges, diffDependencyChange{name, added, removed})
+		}
+	}
+
+	return diff
+}
+
+// requestedClosure returns the closure of the requested
+// packages in dist, as a set.
+func requestedClosure(dist *Distribution) (map[string]bool, error) {
+	pkgs, err := requestedPackages(dist)
+	if err != nil {
+		return nil, err
+	}
+	closure, _ := resolveClosure(dist, pkgs, Args.Excludes())
+	set := make(map[string]bool)
+	for _, name := range closure {
+		set[name] = true
+	}
+	return set, nil
+}
+
+func printDiff(diff *setupIniDiff) {
+	for _, pkg := range diff.Added {
+		fmt.Printf("added: %v %v\n", pkg.Name, pkg.Version)
+	}
+	for _, pkg := range diff.Removed {
+		fmt.Printf("removed: %v %v\n", pkg.Name, pkg.Version)
+	}
+	for _, change := range diff.Upgraded {
+		fmt.Printf("upgraded: %v %v -> %v\n", change.Name, change.OldVersion, change.NewVersion)
+	}
+	for _, change := range diff.Downgraded {
+		fmt.Printf("downgraded: %v %v -> %v\n", change.Name, change.OldVersion, change.NewVersion)
+	}
+	for _, change := range diff.DependencyChanges {
+		deps := []string{}
+		for _, req := range change.Added {
+			deps = append(deps, "+"+req)
+		}
+		for _, req := range change.Removed {
+			deps = append(deps, "-"+req)
+		}
+		fmt.Printf("requires: %v %v\n", change.Name, strings.Join(deps, " "))
+	}
+}
+
+func runDiff(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected exactly two setup.ini arguments, got %v", len(args))
+	}
+
+	oldDist, err := parseSetupIniFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	newDist, err := parseSetupIniFile(args[1])
+	if err != nil {
+		return err
+	}
+
+	// When asked to, only report changes that affect the
+	// closure of the requested packages, in either snapshot.
+	var only map[string]bool
+	if Args.DiffClosure {
+		only, err = requestedClosure(oldDist)
+		if err != nil {
+			return err
+		}
+		newClosure, err := requestedClosure(newDist)
+		if err != nil {
+			return err
+		}
+		for name := range newClosure {
+			only[name] = true
+		}
+	}
+
+	diff := diffDistributions(oldDist, newDist, only)
+
+	if Args.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(diff)
+	}
+
+	printDiff(diff)
+	return nil
+}
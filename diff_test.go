@@ -0,0 +1,71 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const diffOldSetupIni = `release: cygwin
+arch: x86
+setup-timestamp: 1792372447
+
+@ bash
+version: 4.4.12-3
+install: x86/release/bash/bash-4.4.12-3.tar.xz 1 aa
+
+@ mytool
+version: 1.3-1
+install: x86/release/mytool/mytool-1.3-1.tar.xz 1 bb
+requires: bash
+
+@ oldtool
+version: 2.0-1
+install: x86/release/oldtool/oldtool-2.0-1.tar.xz 1 cc
+`
+
+const diffNewSetupIni = `release: cygwin
+arch: x86
+setup-timestamp: 1792458847
+
+@ bash
+version: 4.4.12~rc1-1
+install: x86/release/bash/bash-4.4.12~rc1-1.tar.xz 1 aa
+
+@ mytool
+version: 1.10-1
+install: x86/release/mytool/mytool-1.10-1.tar.xz 1 bb
+requires: bash newtool
+
+@ newtool
+version: 1.0-1
+install: x86/release/newtool/newtool-1.0-1.tar.xz 1 dd
+`
+
+func TestDiffDistributions(t *testing.T) {
+	oldDist := parseSetupIniString(t, diffOldSetupIni)
+	newDist := parseSetupIniString(t, diffNewSetupIni)
+
+	diff := diffDistributions(oldDist, newDist, nil)
+	want := &setupIniDiff{
+		Added:      []diffPackage{{"newtool", "1.0-1"}},
+		Removed:    []diffPackage{{"oldtool", "2.0-1"}},
+		Upgraded:   []diffVersionChange{{"mytool", "1.3-1", "1.10-1"}},
+		Downgraded: []diffVersionChange{{"bash", "4.4.12-3", "4.4.12~rc1-1"}},
+		DependencyChanges: []diffDependencyChange{
+			{Name: "mytool", Added: []string{"newtool"}, Removed: []string{}},
+		},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("got %+v, want %+v", diff, want)
+	}
+
+	diff = diffDistributions(oldDist, newDist, map[string]bool{"bash": true})
+	if len(diff.Downgraded) != 1 || len(diff.Upgraded) != 0 || len(diff.Added) != 0 || len(diff.Removed) != 0 {
+		t.Errorf("diff limited to bash: got %+v", diff)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// downloadMetaSuffix is appended to the path of a downloaded
+// setup.ini (or its signature) to get the path of the file that
+// holds its HTTP cache validators.
+const downloadMetaSuffix = ".meta"
+
+// downloadMeta holds the HTTP cache validators of a download,
+// and the URL they are valid for.
+type downloadMeta struct {
+	URL          string
+	ETag         string
+	LastModified string
+}
+
+// readDownloadMeta reads the cache validators of the download at
+// outFn. A missing or unreadable metadata file yields empty
+// validators.
+func readDownloadMeta(outFn string) downloadMeta {
+	meta := downloadMeta{}
+
+	f, err := os.Open(outFn + downloadMetaSuffix)
+	if err != nil {
+		return meta
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ": ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "url":
+			meta.URL = parts[1]
+		case "etag":
+			meta.ETag = parts[1]
+		case "last-modified":
+			meta.LastModified = parts[1]
+		}
+	}
+
+	return meta
+}
+
+// writeDownloadMeta writes the cache validators of the download
+// at outFn.
+func writeDownloadMeta(outFn string, meta downloadMeta) error {
+	f, err := os.Create(outFn + downloadMetaSuffix)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(f, "url: %v\n", meta.URL)
+	if meta.ETag != "" {
+		fmt.Fprintf(f, "etag: %v\n", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		fmt.Fprintf(f, "last-modified: %v\n", meta.LastModified)
+	}
+
+	return f.Close()
+}
@@ -38,12 +38,34 @@ func ensureParentDirExists(path string) error {
 	return nil
 }
 
-func extractTo(absFn string, targetDir string) error {
+// extractResult describes what extractTo did with the
+// members of an archive. File names are recorded as they
+// appear in the archive. SkippedFiles counts the skipped
+// regular files and links, but not directories.
+type extractResult struct {
+	Files        []string
+	Skipped      []string
+	SkippedFiles int
+	SkippedBytes int64
+}
+
+// extractSavings accumulates the members skipped by path
+// filters across all packages, for the report at the end
+// of an installation.
+var extractSavings struct {
+	Files int
+	Bytes int64
+}
+
+func extractTo(absFn string, targetDir string, filter *pathFilter) (*extractResult, error) {
 	var tr *tar.Reader = nil
 
+	result := &extractResult{}
+	skipped := make(map[string]bool)
+
 	f, err := os.Open(absFn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 
@@ -51,7 +73,7 @@ func extractTo(absFn string, targetDir string) error {
 	if strings.HasSuffix(absFn, ".tar.gz") || strings.HasSuffix(absFn, ".tgz") {
 		gzr, err := gzip.NewReader(f)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		tr = tar.NewReader(gzr)
 		// bz2
@@ -61,7 +83,7 @@ func extractTo(absFn string, targetDir string) error {
 	} else if strings.HasSuffix(absFn, ".tar.xz") {
 		xzr, err := xz.NewReader(f)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		tr = tar.NewReader(xzr)
 		// lzma, etc?
@@ -74,13 +96,30 @@ func extractTo(absFn string, targetDir string) error {
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return nil, err
 		}
 
 		if !checkFn(hdr.Name) {
 			log.Fatal("bad fn in tarball: %v", hdr.Name)
 		}
 
+		// Apply path filters. Hard links to skipped files
+		// are skipped as well, since there is nothing to
+		// link to.
+		if filter.Skip(hdr.Name) || (hdr.Typeflag == tar.TypeLink && skipped[hdr.Linkname]) {
+			skipped[hdr.Name] = true
+			result.Skipped = append(result.Skipped, hdr.Name)
+			switch hdr.Typeflag {
+			case tar.TypeReg, tar.TypeRegA:
+				result.SkippedFiles++
+				result.SkippedBytes += hdr.Size
+			case tar.TypeLink, tar.TypeSymlink:
+				result.SkippedFiles++
+			}
+			continue
+		}
+		result.Files = append(result.Files, hdr.Name)
+
 		// Map /usr/bin -> /bin
 		if strings.HasPrefix(hdr.Name, "usr/bin") {
 			hdr.Name = strings.Replace(hdr.Name, "usr/bin", "bin", 1)
@@ -100,51 +139,54 @@ func extractTo(absFn string, targetDir string) error {
 			path := filepath.Join(targetDir, hdr.Name)
 			err = ensureParentDirExists(path)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			f, err := os.Create(path)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			defer f.Close()
 
 			_, err = io.Copy(f, tr)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		} else if hdr.Typeflag == tar.TypeDir {
 			err = os.MkdirAll(filepath.Join(targetDir, hdr.Name), 0750)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		} else if hdr.Typeflag == tar.TypeLink {
 			path := filepath.Join(targetDir, hdr.Name)
 			err = ensureParentDirExists(path)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			err = os.Link(filepath.Join(targetDir, hdr.Linkname), path)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		} else if hdr.Typeflag == tar.TypeSymlink {
 			path := filepath.Join(targetDir, hdr.Name)
 			err = ensureParentDirExists(path)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			err = cyglink(path, hdr.Linkname)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		} else {
 			log.Fatalf("fatal error: unhandled typeflag %v", hdr.Typeflag)
 		}
 	}
 
-	return nil
+	extractSavings.Files += result.SkippedFiles
+	extractSavings.Bytes += result.SkippedBytes
+
+	return result, nil
 }
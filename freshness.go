@@ -0,0 +1,260 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acceptedTimestampDir returns the directory that the newest
+// accepted setup-timestamps are recorded in. It must outlive the
+// run, so it is -timestamp-dir, or a directory in -cache-dir, or
+// in the per-user configuration directory, in that order. It
+// returns "" if there is no such directory.
+func acceptedTimestampDir() string {
+	if Args.TimestampDir != "" {
+		return Args.TimestampDir
+	}
+	if Args.CacheDir != "" {
+		return filepath.Join(Args.CacheDir, "timestamps")
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, progName, "timestamps")
+}
+
+// acceptedTimestampPath returns the path of the file that
+// records the newest setup-timestamp accepted for repo, or ""
+// if there is nowhere to record it.
+func acceptedTimestampPath(repo *Repository) string {
+	dir := acceptedTimestampDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, repo.Name+"-"+Args.Arch+".setup-timestamp")
+}
+
+// readAcceptedTimestamp returns the newest setup-timestamp
+// accepted for repo, or the zero time if none was recorded.
+func readAcceptedTimestamp(repo *Repository) (time.Time, error) {
+	buf, err := ioutil.ReadFile(acceptedTimestampPath(repo))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed accepted timestamp in '%v'", acceptedTimestampPath(repo))
+	}
+	return time.Unix(secs, 0), nil
+}
+
+func writeAcceptedTimestamp(repo *Repository, ts time.Time) error {
+	path := acceptedTimestampPath(repo)
+	err := ensureParentDirExists(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strconv.FormatInt(ts.Unix(), 10)+"\n"), 0644)
+}
+
+// checkSetupIniFreshness protects against rollback and freeze
+// attacks, where a mirror serves an old, but validly signed,
+// setup.ini. It refuses a setup.ini whose setup-timestamp is
+// older than the newest one previously accepted for repo, or
+// older than -max-setup-age, unless -allow-rollback is given.
+//
+// The newest accepted setup-timestamp is recorded for the
+// next run.
+func checkSetupIniFreshness(repo *Repository, dist *Distribution) error {
+	ts, err := dist.Timestamp()
+	if err != nil {
+		if !Args.AllowRollback {
+			return fmt.Errorf("%v (use -allow-rollback to accept it)", err)
+		}
+		log.Printf("WARNING: accepting setup.ini from repository '%v' without a valid setup-timestamp: %v", repo, err)
+		return nil
+	}
+
+	path := acceptedTimestampPath(repo)
+	accepted := time.Time{}
+	if path == "" {
+		log.Printf("WARNING: no -timestamp-dir, -cache-dir or per-user configuration directory to record setup.ini timestamps in; rollback protection for repository '%v' is OFF", repo)
+	} else {
+		accepted, err = readAcceptedTimestamp(repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ts.Before(accepted) {
+		if !Args.AllowRollback {
+			return fmt.Errorf("setup.ini rollback: setup-timestamp %v is older than previously accepted %v (use -allow-rollback to accept it)", ts.UTC(), accepted.UTC())
+		}
+		log.Printf("accepting setup.ini from repository '%v' older than previously accepted (%v < %v)", repo, ts.UTC(), accepted.UTC())
+	}
+
+	if Args.MaxSetupAge > 0 {
+		age := time.Since(ts)
+		if age > Args.MaxSetupAge {
+			if !Args.AllowRollback {
+				return fmt.Errorf("setup.ini is too old: setup-timestamp %v is older than -max-setup-age %v (use -allow-rollback to accept it)", ts.UTC(), Args.MaxSetupAge)
+			}
+			log.Printf("accepting setup.ini from repository '%v' older than -max-setup-age (%v)", repo, ts.UTC())
+		}
+	}
+
+	if ts.After(accepted) && path != "" {
+		err = writeAcceptedTimestamp(repo, ts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mirrorProblems records mirrors that turned out to be stale
+// or to serve files that don't match setup.ini, for the report
+// at the end of a run.
+type mirrorProblems struct {
+	mu       sync.Mutex
+	problems map[string][]string
+}
+
+var mirrorReport = &mirrorProblems{problems: make(map[string][]string)}
+
+func (mp *mirrorProblems) add(mirror string, problem string) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.problems[mirror] = append(mp.problems[mirror], problem)
+}
+
+// Stale records that mirror's setup.ini is older than the one
+// in use.
+func (mp *mirrorProblems) Stale(mirror string, ts time.Time, want time.Time) {
+	log.Printf("mirror '%v' is stale: setup-timestamp %v < %v", mirror, ts.UTC(), want.UTC())
+	mp.add(mirror, fmt.Sprintf("stale setup.ini (%v < %v)", ts.UTC(), want.UTC()))
+}
+
+// Unreachable records that the freshness of mirror could not
+// be determined.
+func (mp *mirrorProblems) Unreachable(mirror string, err error) {
+	log.Printf("mirror '%v' is unusable: %v", mirror, err)
+	mp.add(mirror, fmt.Sprintf("unable to check setup.ini: %v", err))
+}
+
+// Inconsistent records that mirror served a file that does not
+// match its size and SHA-512 sum in setup.ini.
+func (mp *mirrorProblems) Inconsistent(mirror string, relativeUrl string, err error) {
+	log.Printf("mirror '%v' served an inconsistent file: %v", mirror, err)
+	mp.add(mirror, fmt.Sprintf("inconsistent file %v", relativeUrl))
+}
+
+// Print logs all recorded problems.
+func (mp *mirrorProblems) Print() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mirrors := []string{}
+	for mirror := range mp.problems {
+		mirrors = append(mirrors, mirror)
+	}
+	sort.Strings(mirrors)
+
+	for _, mirror := range mirrors {
+		log.Printf("mirror problems: '%v': %v", mirror, strings.Join(mp.problems[mirror], "; "))
+	}
+}
+
+// SetSetupIniSource records the mirror that setup.ini of repo
+// was loaded from, and its setup-timestamp.
+func (repo *Repository) SetSetupIniSource(mirror string, ts time.Time) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.setupMirror = mirror
+	repo.setupTimestamp = ts
+	if mirror == "" {
+		log.Printf("using setup.ini of repository '%v' from the distfiles directories (setup-timestamp %v)", repo, ts.UTC())
+		return
+	}
+	log.Printf("using setup.ini of repository '%v' from mirror '%v' (setup-timestamp %v)", repo, mirror, ts.UTC())
+}
+
+// PreferredMirrors returns the mirrors of repo, with the mirror
+// that setup.ini was loaded from first.
+func (repo *Repository) PreferredMirrors() []string {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.setupMirror == "" {
+		return repo.Mirrors
+	}
+	mirrors := []string{repo.setupMirror}
+	for _, mirror := range repo.Mirrors {
+		if mirror != repo.setupMirror {
+			mirrors = append(mirrors, mirror)
+		}
+	}
+	return mirrors
+}
+
+// IsFreshMirror reports whether mirror can be used to download
+// files of repo, which is the case if its setup.ini is at least
+// as new as the one that is in use.
+func (repo *Repository) IsFreshMirror(mirror string) bool {
+	repo.mu.Lock()
+	if repo.setupMirror == "" || mirror == repo.setupMirror || repo.pooledMirrors {
+		repo.mu.Unlock()
+		return true
+	}
+	ts, ok := repo.mirrorTimestamps[mirror]
+	setupTimestamp := repo.setupTimestamp
+	repo.mu.Unlock()
+
+	if ok {
+		return !ts.Before(setupTimestamp)
+	}
+
+	// Probe without holding the lock, so that other downloads
+	// aren't held up by a slow mirror.
+	probe := probeMirror(mirror)
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.mirrorTimestamps == nil {
+		repo.mirrorTimestamps = make(map[string]time.Time)
+	}
+	if ts, ok := repo.mirrorTimestamps[mirror]; ok {
+		// Probed concurrently; already reported.
+		return !ts.Before(repo.setupTimestamp)
+	}
+	if probe.Err != nil {
+		mirrorReport.Unreachable(mirror, probe.Err)
+	}
+	// Failed probes are recorded as the zero time,
+	// so that the mirror is treated as stale.
+	ts = probe.Timestamp
+	repo.mirrorTimestamps[mirror] = ts
+	if probe.Err == nil && ts.Before(repo.setupTimestamp) {
+		mirrorReport.Stale(mirror, ts, repo.setupTimestamp)
+	}
+
+	return !ts.Before(repo.setupTimestamp)
+}
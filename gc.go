@@ -0,0 +1,250 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gcReport tallies what the gc command removed.
+type gcReport struct {
+	Files int
+	Bytes int64
+}
+
+// remove removes the file at absFn, unless -dry-run is given.
+func (r *gcReport) remove(absFn string, fi os.FileInfo, why string) error {
+	if Args.DryRun {
+		log.Printf("would remove %v '%v' (%v bytes)", why, absFn, fi.Size())
+	} else {
+		log.Printf("removing %v '%v' (%v bytes)", why, absFn, fi.Size())
+		err := os.Remove(absFn)
+		if err != nil {
+			return err
+		}
+	}
+	r.Files++
+	r.Bytes += fi.Size()
+	return nil
+}
+
+// referencedArchives adds the relative URLs and SHA-512 sums of
+// all archives referenced by dist to urls and sums.
+func referencedArchives(dist *Distribution, urls map[string]bool, sums map[string]bool) {
+	for _, pkg := range dist.Packages {
+		for _, section := range setupIniSections {
+			for _, field := range []string{"install", "source"} {
+				info, ok := pkg.Meta[section+field].([]string)
+				if !ok || len(info) != 3 {
+					continue
+				}
+				urls[info[0]] = true
+				sums[info[2]] = true
+			}
+		}
+	}
+}
+
+// distfileArchiveURL returns the mirror-relative URL of the
+// distfile rel, relative to the distfiles directory, if it is
+// a package archive.
+//
+// Only files below a release directory are archives; setup.ini,
+// its signature and metadata, and accepted timestamps are never
+// collected.
+func distfileArchiveURL(rel string) (string, bool) {
+	parts := strings.Split(rel, "/")
+	if len(parts) > 2 && parts[0] == "repos" {
+		parts = parts[2:]
+	}
+	for _, part := range parts[:len(parts)-1] {
+		if part == "release" {
+			return strings.Join(parts, "/"), true
+		}
+	}
+	return "", false
+}
+
+// isStrayPart reports whether fi is a partial download that is
+// no longer being written to.
+func isStrayPart(absFn string, fi os.FileInfo) bool {
+	if !strings.HasSuffix(absFn, ".part") {
+		return false
+	}
+	if _, err := os.Stat(strings.TrimSuffix(absFn, ".part") + ".lock"); err == nil {
+		return false
+	}
+	return time.Since(fi.ModTime()) > cacheLockStaleAge
+}
+
+// removeEmptyDirs removes all empty directories below root,
+// deepest first.
+func removeEmptyDirs(root string) {
+	dirs := []string{}
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	for _, dir := range dirs {
+		// Fails for directories that aren't empty.
+		if os.Remove(dir) == nil {
+			log.Printf("removed empty directory '%v'", dir)
+		}
+	}
+}
+
+// gcDistfiles removes the archives in the distfiles directory
+// dir that aren't in urls and whose base name isn't in names,
+// and stray partial downloads. The SHA-512 sums of archives kept
+// for their name are added to sums, so that their cache entries
+// are kept as well.
+func gcDistfiles(dir string, urls map[string]bool, names map[string]bool, sums map[string]bool, report *gcReport) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		if strings.HasSuffix(path, ".part") {
+			if isStrayPart(path, fi) {
+				return report.remove(path, fi, "partial download")
+			}
+			// Still being written to by another run.
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		url, ok := distfileArchiveURL(filepath.ToSlash(rel))
+		if !ok || urls[url] {
+			return nil
+		}
+		if names[filepath.Base(path)] {
+			_, sum, err := fileSHA512(path)
+			if err != nil {
+				return err
+			}
+			sums[sum] = true
+			return nil
+		}
+		return report.remove(path, fi, "unreferenced archive")
+	})
+}
+
+// gcCache removes the entries of the -cache-dir cache that
+// aren't in sums, and stray partial downloads. Only the files
+// below dir that are named by a SHA-512 sum are cache entries;
+// everything else, such as accepted timestamps, is kept.
+func gcCache(dir string, sums map[string]bool, report *gcReport) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+
+		if strings.HasSuffix(path, ".part") {
+			if isStrayPart(path, fi) {
+				return report.remove(path, fi, "partial download")
+			}
+			return nil
+		}
+
+		sum := filepath.Base(path)
+		if !isSHA512Hex(sum) {
+			return nil
+		}
+		if _, err := os.Stat(path + ".lock"); err == nil {
+			// In use by a running download.
+			return nil
+		}
+		if !sums[sum] {
+			return report.remove(path, fi, "unreferenced cache entry")
+		}
+		return nil
+	})
+}
+
+// runGC collects garbage in the distfiles and cache directories.
+// The archives to keep are given by setup.ini files, which keep
+// the archives they reference, and installed.db files, which keep
+// the archives of the packages they record, by name.
+func runGC(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected at least one setup.ini or installed.db argument")
+	}
+
+	urls := make(map[string]bool)
+	names := make(map[string]bool)
+	sums := make(map[string]bool)
+	for _, path := range args {
+		archives, err := readInstalledDbArchives(path)
+		if err == nil {
+			for _, archive := range archives {
+				names[archive] = true
+			}
+			continue
+		} else if err != errNotInstalledDb {
+			return fmt.Errorf("unable to read '%v': %v", path, err)
+		}
+
+		dist, err := parseSetupIniFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to parse '%v': %v", path, err)
+		}
+		referencedArchives(dist, urls, sums)
+	}
+	log.Printf("%v archives are still in use", len(urls))
+	if len(names) > 0 {
+		log.Printf("%v archives are still installed", len(names))
+	}
+
+	report := &gcReport{}
+	dirs := []string{Args.Distfiles()}
+	err := gcDistfiles(Args.Distfiles(), urls, names, sums, report)
+	if err != nil {
+		return err
+	}
+
+	if Args.CacheDir != "" {
+		dirs = append(dirs, cacheEntriesDir())
+		err = gcCache(cacheEntriesDir(), sums, report)
+		if err != nil {
+			return err
+		}
+	}
+
+	if Args.DryRun {
+		log.Printf("would reclaim %v bytes in %v files", report.Bytes, report.Files)
+		return nil
+	}
+
+	for _, dir := range dirs {
+		removeEmptyDirs(dir)
+	}
+
+	log.Printf("reclaimed %v bytes in %v files", report.Bytes, report.Files)
+	return nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	httpTransportOnce sync.Once
+	httpTransport     *http.Transport
+	httpTransportErr  error
+
+	proxyLogMu  sync.Mutex
+	proxyLogged = make(map[string]bool)
+)
+
+// userAgent is the User-Agent of all HTTP requests.
+func userAgent() string {
+	return progName + "/" + progVersion
+}
+
+// mirrorHeader is an extra request header for the mirrors whose
+// URLs start with Prefix, given via -mirror-header.
+type mirrorHeader struct {
+	Prefix string
+	Key    string
+	Value  string
+}
+
+// parseMirrorHeader parses a -mirror-header, in the form
+// <mirror URL>=<Header>: <value>.
+func parseMirrorHeader(spec string) (mirrorHeader, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return mirrorHeader{}, fmt.Errorf("malformed mirror header '%v': missing mirror", spec)
+	}
+	header := strings.SplitN(parts[1], ":", 2)
+	if len(header) != 2 || strings.TrimSpace(header[0]) == "" {
+		return mirrorHeader{}, fmt.Errorf("malformed mirror header '%v': missing header name", spec)
+	}
+	return mirrorHeader{
+		Prefix: strings.TrimSuffix(parts[0], "/"),
+		Key:    strings.TrimSpace(header[0]),
+		Value:  strings.TrimSpace(header[1]),
+	}, nil
+}
+
+// readTimeoutConn is a net.Conn that fails reads that take
+// longer than timeout, so that stalled downloads are noticed.
+type readTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *readTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+// newHTTPTransport returns a transport configured via the
+// -connect-timeout, -read-timeout, -ca-bundle, -client-cert,
+// -client-key and -max-connections-per-host arguments. Proxies
+// are taken from the environment.
+func newHTTPTransport() (*http.Transport, error) {
+	tlsConfig := &tls.Config{}
+
+	if Args.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(Args.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle '%v'", Args.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if Args.ClientCert != "" {
+		keyFile := Args.ClientKey
+		if keyFile == "" {
+			keyFile = Args.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(Args.ClientCert, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   Args.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || Args.ReadTimeout == 0 {
+				return conn, err
+			}
+			return &readTimeoutConn{Conn: conn, timeout: Args.ReadTimeout}, nil
+		},
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   Args.ConnectTimeout,
+		ResponseHeaderTimeout: Args.ReadTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxConnsPerHost:       Args.MaxConnsPerHost,
+	}, nil
+}
+
+// logProxy logs the proxy used for the host of req, once per
+// host.
+func logProxy(req *http.Request) {
+	host := req.URL.Scheme + "://" + req.URL.Host
+
+	proxyLogMu.Lock()
+	defer proxyLogMu.Unlock()
+
+	if proxyLogged[host] {
+		return
+	}
+	proxyLogged[host] = true
+
+	proxy, err := http.ProxyFromEnvironment(req)
+	if err != nil {
+		log.Printf("invalid proxy settings for %v: %v", host, err)
+	} else if proxy != nil {
+		// Don't log proxy credentials.
+		proxy.User = nil
+		log.Printf("using proxy '%v' for %v", proxy, host)
+	} else {
+		log.Printf("connecting to %v directly", host)
+	}
+}
+
+// newHTTPRequest returns a request for url with the User-Agent
+// and the -mirror-header headers that apply to url.
+func newHTTPRequest(method string, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", userAgent())
+	err = setMirrorHeaders(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// setMirrorHeaders sets the -mirror-header headers that apply to
+// the URL of req, and removes those that don't.
+func setMirrorHeaders(req *http.Request) error {
+	url := req.URL.String()
+	headers := []mirrorHeader{}
+	for _, spec := range Args.MirrorHeaders {
+		header, err := parseMirrorHeader(spec)
+		if err != nil {
+			return err
+		}
+		headers = append(headers, header)
+	}
+
+	for _, header := range headers {
+		req.Header.Del(header.Key)
+	}
+	for _, header := range headers {
+		if url == header.Prefix || strings.HasPrefix(url, header.Prefix+"/") {
+			req.Header.Set(header.Key, header.Value)
+		}
+	}
+	return nil
+}
+
+// checkRedirect is the http.Client CheckRedirect function of
+// doHTTPRequest. net/http copies the headers of the original
+// request to redirects, even to other hosts, so the -mirror-header
+// headers are applied anew to the redirect URL, so that they
+// don't leak to, say, a CDN that the mirror redirects to.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	// Same limit as the default policy.
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return setMirrorHeaders(req)
+}
+
+// doHTTPRequest sends req with the shared transport. The whole
+// request, including reading the response body, must finish
+// within timeout, unless timeout is 0. Reading the response body
+// is limited to -max-rate, shared with all other requests.
+func doHTTPRequest(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	httpTransportOnce.Do(func() {
+		httpTransport, httpTransportErr = newHTTPTransport()
+	})
+	if httpTransportErr != nil {
+		return nil, httpTransportErr
+	}
+
+	logProxy(req)
+
+	client := &http.Client{
+		Transport:     httpTransport,
+		CheckRedirect: checkRedirect,
+		Timeout:       timeout,
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body = limitDownload(rsp.Body)
+	return rsp, nil
+}
@@ -44,6 +44,10 @@ func installPkg(name string, dist *Distribution, targetDir string, excludeRequir
 			// Skip excluded requirement.
 			continue
 		}
+		if isExcluded(req, Args.Excludes()) {
+			// Dropped via -exclude.
+			continue
+		}
 		if !dist.IsInstalled(req) {
 			newExcludeRequirements := []string{}
 			newExcludeRequirements = append(newExcludeRequirements, excludeRequirements...)
@@ -57,8 +61,11 @@ func installPkg(name string, dist *Distribution, targetDir string, excludeRequir
 
 	relativeUrl, fileSize, sha512sum := pkg.InstallInfo()
 
-	ensureDownloaded(relativeUrl, fileSize, sha512sum)
-	absFn := distfilePath(relativeUrl)
+	err = ensureDownloaded(pkg.Repo, relativeUrl, fileSize, sha512sum)
+	if err != nil {
+		return err
+	}
+	absFn := pkg.Repo.FilePath(relativeUrl)
 
 	if !Args.FetchOnly {
 		err = os.MkdirAll(targetDir, 0750)
@@ -68,11 +75,28 @@ func installPkg(name string, dist *Distribution, targetDir string, excludeRequir
 			return err
 		}
 
-		err = extractTo(absFn, targetDir)
+		filter, err := Args.PathFilter()
+		if err != nil {
+			return err
+		}
+
+		result, err := extractTo(absFn, targetDir, filter)
 		if err != nil {
 			return err
 		}
 
+		err = writeFileList(targetDir, name, "", result.Files)
+		if err != nil {
+			return err
+		}
+
+		if len(result.Skipped) > 0 {
+			err = writeFileList(targetDir, name, ".skipped", result.Skipped)
+			if err != nil {
+				return err
+			}
+		}
+
 		postInstallDir := filepath.Join(targetDir, "etc", "postinstall")
 
 		f, err := os.Open(postInstallDir)
@@ -0,0 +1,205 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// installedDbHeader is the header of version 3 of the
+// installed.db format, as written by Cygwin's setup.exe.
+const installedDbHeader = "INSTALLED.DB 3\n"
+
+// errNotInstalledDb is returned by readInstalledDbArchives for
+// files that aren't an installed.db.
+var errNotInstalledDb = errors.New("not an installed.db")
+
+// readInstalledDbArchives returns the base names of the archives
+// of the packages recorded in the installed.db at path.
+func readInstalledDbArchives(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "INSTALLED.DB ") {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errNotInstalledDb
+	}
+
+	archives := []string{}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		archives = append(archives, fields[1])
+	}
+	return archives, scanner.Err()
+}
+
+// writeInstalledDb writes /etc/setup/installed.db for all
+// packages in dist that are marked as installed, so that
+// setup.exe (and cygcheck) can be used on the target later on.
+//
+// Packages that are provided externally are recorded just like
+// installed packages. That keeps setup.exe from trying to
+// install them again as a dependency of some other package.
+func writeInstalledDb(targetDir string, dist *Distribution) error {
+	setupDir := filepath.Join(targetDir, "etc", "setup")
+	err := os.MkdirAll(setupDir, 0750)
+	if os.IsExist(err) {
+		// OK...
+	} else if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range dist.InstalledPackages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f, err := os.Create(filepath.Join(setupDir, "installed.db"))
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	_, err = w.WriteString(installedDbHeader)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	for _, name := range names {
+		pkg, err := dist.Get(name)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		relativeUrl, _, _ := pkg.InstallInfo()
+		if relativeUrl == "" {
+			continue
+		}
+		_, err = w.WriteString(name + " " + path.Base(relativeUrl) + " 0\n")
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// writeFileList writes the gzipped file list of a package to
+// /etc/setup/<name><suffix>.lst.gz.
+//
+// The file list of a package (suffix "") records the files
+// that were extracted to the target, just like setup.exe does.
+// Archive members that were dropped by path filters are
+// recorded in a separate list with the suffix ".skipped".
+func writeFileList(targetDir string, name string, suffix string, entries []string) error {
+	setupDir := filepath.Join(targetDir, "etc", "setup")
+	err := os.MkdirAll(setupDir, 0750)
+	if os.IsExist(err) {
+		// OK...
+	} else if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(setupDir, name+suffix+".lst.gz"))
+	if err != nil {
+		return err
+	}
+
+	gzw := gzip.NewWriter(f)
+	for _, entry := range entries {
+		_, err = gzw.Write([]byte(entry + "\n"))
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = gzw.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// writeProvenanceDb writes /etc/setup/provenance.db, which
+// records the repository each installed package came from, as
+// one "<package> <repository>" line per package.
+func writeProvenanceDb(targetDir string, dist *Distribution) error {
+	setupDir := filepath.Join(targetDir, "etc", "setup")
+	err := os.MkdirAll(setupDir, 0750)
+	if os.IsExist(err) {
+		// OK...
+	} else if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range dist.InstalledPackages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f, err := os.Create(filepath.Join(setupDir, "provenance.db"))
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, name := range names {
+		pkg, err := dist.Get(name)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		repo := "unknown"
+		if dist.IsProvided(name) {
+			repo = "external"
+		} else if pkg.Repo != nil {
+			repo = pkg.Repo.Name
+		}
+		_, err = w.WriteString(name + " " + repo + "\n")
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
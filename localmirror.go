@@ -0,0 +1,125 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Modes for -local-mirror-mode.
+const (
+	// localMirrorDirect uses files of local mirrors in place.
+	localMirrorDirect = "direct"
+	// localMirrorLink hard links files of local mirrors into
+	// the distfiles directory, copying them if that fails.
+	localMirrorLink = "link"
+	// localMirrorCopy copies files of local mirrors into the
+	// distfiles directory.
+	localMirrorCopy = "copy"
+)
+
+// localMirrorDir returns the directory of mirror if it is a
+// local mirror, given either as a file:// URL or as a plain
+// path.
+func localMirrorDir(mirror string) (string, bool) {
+	if strings.HasPrefix(mirror, "file://") {
+		u, err := url.Parse(mirror)
+		if err != nil {
+			return "", false
+		}
+		path := u.Path
+		if u.Host != "" && u.Host != "localhost" {
+			// file://server/share/... is a UNC path.
+			return `\\` + u.Host + filepath.FromSlash(path), true
+		}
+		// file:///C:/cygwin is C:/cygwin, not /C:/cygwin.
+		if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+			path = path[1:]
+		}
+		return filepath.FromSlash(path), true
+	}
+	if !strings.Contains(mirror, "://") {
+		return mirror, true
+	}
+	return "", false
+}
+
+// linkOrCopy hard links src to dst, falling back to copying if
+// src and dst are on different volumes.
+func linkOrCopy(src string, dst string) error {
+	err := ensureParentDirExists(dst)
+	if err != nil {
+		return err
+	}
+	os.Remove(dst)
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// fetchFromLocalMirror makes mirrorRelativeURL of the local
+// mirror in dir available, as determined by -local-mirror-mode,
+// and returns the path it can be read from.
+func fetchFromLocalMirror(dir string, mirrorRelativeURL string, outFn string) (string, error) {
+	src := filepath.Join(dir, filepath.FromSlash(mirrorRelativeURL))
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%v is not a regular file", src)
+	}
+
+	switch Args.LocalMirrorMode {
+	case localMirrorLink:
+		return outFn, linkOrCopy(src, outFn)
+	case localMirrorCopy:
+		// outFn may be a hard link to the mirror's file or
+		// to a cache entry, so it must be replaced rather
+		// than written to.
+		partFn := outFn + ".part"
+		err = copyFile(src, partFn)
+		if err != nil {
+			os.Remove(partFn)
+			return "", err
+		}
+		return outFn, os.Rename(partFn, outFn)
+	}
+	return src, nil
+}
+
+// FilePath returns the path that mirrorRelativeURL of repo can
+// be read from once it has been downloaded. That is the path of
+// its distfile, unless it was found on a local mirror that is
+// used in place.
+func (repo *Repository) FilePath(mirrorRelativeURL string) string {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if path, ok := repo.localFiles[mirrorRelativeURL]; ok {
+		return path
+	}
+	return repo.DistfilePath(mirrorRelativeURL)
+}
+
+// setFilePath records the path that mirrorRelativeURL of repo
+// can be read from.
+func (repo *Repository) setFilePath(mirrorRelativeURL string, path string) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if repo.localFiles == nil {
+		repo.localFiles = make(map[string]string)
+	}
+	if path == repo.DistfilePath(mirrorRelativeURL) {
+		delete(repo.localFiles, mirrorRelativeURL)
+	} else {
+		repo.localFiles[mirrorRelativeURL] = path
+	}
+}
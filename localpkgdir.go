@@ -0,0 +1,135 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// localPackageDirMirror is a mirror subdirectory of a setup.exe
+// local package directory.
+type localPackageDirMirror struct {
+	Dir       string
+	Mirror    string
+	Timestamp time.Time
+}
+
+// isLocalPackageDirMirror reports whether name is the name of
+// a mirror subdirectory in a setup.exe local package directory,
+// i.e. a URL-encoded mirror URL such as
+// http%3a%2f%2fmirror%2f, and returns the decoded URL.
+func isLocalPackageDirMirror(name string) (string, bool) {
+	mirror, err := url.QueryUnescape(name)
+	if err != nil || mirror == name || !strings.Contains(mirror, "://") {
+		return "", false
+	}
+	return mirror, true
+}
+
+// readLocalPackageDirMirror finds the setup.ini variant for the
+// selected architecture in the mirror subdirectory dir, verifies
+// its signature against the keys trusted for repo, and returns
+// its setup-timestamp.
+func readLocalPackageDirMirror(repo *Repository, dir string) (time.Time, error) {
+	for _, variant := range setupIniVariants {
+		path := filepath.Join(dir, Args.Arch, variant)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		_, err := verifyFileSignature(repo, path, path+".sig")
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%v: %v", variant, err)
+		}
+
+		r, err := openSetupIniVariant(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		header, err := parseSetupIniHeader(r)
+		r.Close()
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		dist := NewDistribution()
+		dist.Packages = append(dist.Packages, header)
+		return dist.Timestamp()
+	}
+	return time.Time{}, os.ErrNotExist
+}
+
+// localPackageDirMirrors returns the mirror subdirectories of
+// the setup.exe local package directory dir that have a setup.ini
+// signed by a key trusted for repo, newest first.
+func localPackageDirMirrors(repo *Repository, dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []localPackageDirMirror{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		mirror, ok := isLocalPackageDirMirror(entry.Name())
+		if !ok {
+			continue
+		}
+
+		mirrorDir := filepath.Join(dir, entry.Name())
+		ts, err := readLocalPackageDirMirror(repo, mirrorDir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Printf("skipping local package directory mirror '%v': %v", mirror, err)
+			continue
+		}
+		found = append(found, localPackageDirMirror{Dir: mirrorDir, Mirror: mirror, Timestamp: ts})
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no verified %v setup.ini in local package directory '%v'", Args.Arch, dir)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Timestamp.After(found[j].Timestamp)
+	})
+
+	mirrors := []string{}
+	for _, m := range found {
+		log.Printf("local package directory mirror '%v' has setup.ini from %v", m.Mirror, m.Timestamp.UTC())
+		mirrors = append(mirrors, m.Dir)
+	}
+	return mirrors, nil
+}
+
+// useLocalPackageDir makes repo use the mirror subdirectories of
+// the setup.exe local package directory dir instead of its own
+// mirrors.
+//
+// setup.exe keeps each archive only under the mirror it happened
+// to be downloaded from, so all subdirectories are used for
+// archives regardless of the age of their setup.ini. Archives
+// are still verified against the newest setup.ini.
+func useLocalPackageDir(repo *Repository, dir string) error {
+	mirrors, err := localPackageDirMirrors(repo, dir)
+	if err != nil {
+		return err
+	}
+	repo.Mirrors = mirrors
+	repo.pooledMirrors = true
+	return nil
+}
@@ -18,23 +18,38 @@ import (
 	"strings"
 )
 
+// distfilePath returns the path of a file in the writable
+// -distfiles directory, which is where downloads go. Files may
+// also be found in the read-only directories; see findDistfile
+// and findSetupIni.
 func distfilePath(args ...string) string {
 	path := []string{Args.Distfiles()}
 	path = append(path, args...)
 	return filepath.Join(path...)
 }
 
-func checkSHA512(absFn string, expectedLength int64, insha512 string) error {
-	hw := sha512.New512_256()
+// fileSHA512 returns the size and hex-encoded SHA-512 sum of
+// the file at absFn.
+func fileSHA512(absFn string) (int64, string, error) {
+	hw := sha512.New()
 
 	f, err := os.Open(absFn)
 	if err != nil {
-		return err
+		return 0, "", err
 	}
 
 	defer f.Close()
 
 	n, err := io.Copy(hw, f)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return n, hex.EncodeToString(hw.Sum(nil)), nil
+}
+
+func checkSHA512(absFn string, expectedLength int64, insha512 string) error {
+	n, sumHex, err := fileSHA512(absFn)
 	if err != nil {
 		return err
 	}
@@ -43,9 +58,6 @@ func checkSHA512(absFn string, expectedLength int64, insha512 string) error {
 		return fmt.Errorf("Length mismsatch for '%v'. Has %v, want %v", absFn, n, expectedLength)
 	}
 
-	sumBytes := hw.Sum(nil)
-	sumHex := hex.EncodeToString(sumBytes)
-
 	if sumHex != insha512 {
 		return fmt.Errorf("SHA512 mismatch for %v. Has %v, want %v", absFn, sumHex, insha512)
 	}
@@ -53,64 +65,165 @@ func checkSHA512(absFn string, expectedLength int64, insha512 string) error {
 	return nil
 }
 
-func ensureDownloaded(mirrorRelativeURL string, fileSize int64, sha512sum string) error {
-	mirrors := []string{}
-	for _, mirror := range Args.Mirrors() {
-		mirrors = append(mirrors, mirror)
+// downloadFromMirror downloads mirrorRelativeURL from the mirror
+// mirrorBase to outFn. The download is written to outFn + ".part"
+// first, and only renamed to outFn once it is complete.
+//
+// setup.ini and its signature are fetched with a conditional
+// GET if outFn was previously downloaded from the same URL, and
+// the existing outFn is kept if the mirror reports that it has
+// not been modified.
+func downloadFromMirror(mirrorBase string, mirrorRelativeURL string, outFn string) error {
+	url := mirrorBase + "/" + mirrorRelativeURL
+
+	// Amazon S3 requires + signs in the URL to be
+	// URL escaped.
+	escapedUrl := strings.Replace(url, "+", "%2B", -1)
+
+	dir := filepath.Dir(outFn)
+	err := os.MkdirAll(dir, 0755)
+	if os.IsExist(err) {
+		// All directories we require already exist. All good.
+	} else if err != nil {
+		log.Fatalf("unable to mkdir: %v", err)
+	}
+
+	req, err := newHTTPRequest(http.MethodGet, escapedUrl)
+	if err != nil {
+		return err
 	}
 
-	for {
-		if len(mirrors) == 0 {
-			return errors.New("no remaining mirrors")
+	conditional := isSetupIniFile(mirrorRelativeURL)
+	if conditional {
+		meta := readDownloadMeta(outFn)
+		if _, err := os.Stat(outFn); err == nil && meta.URL == url {
+			if meta.ETag != "" {
+				req.Header.Set("If-None-Match", meta.ETag)
+			}
+			if meta.LastModified != "" {
+				req.Header.Set("If-Modified-Since", meta.LastModified)
+			}
 		}
+	}
 
-		// Take the front-most mirror.
-		mirrorBase := mirrors[0]
-		mirrors = mirrors[1:]
+	rsp, err := doHTTPRequest(req, Args.Timeout)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
 
-		url := mirrorBase + "/" + mirrorRelativeURL
+	if conditional && rsp.StatusCode == http.StatusNotModified {
+		log.Printf("%v not modified, reusing cached copy", url)
+		return nil
+	}
 
-		// Amazon S3 requires + signs in the URL to be
-		// URL escaped.
-		escapedUrl := strings.Replace(url, "+", "%2B", -1)
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch %v: %v", url, rsp.Status)
+	}
 
-		outFn := distfilePath(mirrorRelativeURL)
-		dir := filepath.Dir(outFn)
-		err := os.MkdirAll(dir, 0755)
-		if os.IsExist(err) {
-			// All directories we require already exist. All good.
-		} else if err != nil {
-			log.Fatalf("unable to mkdir: %v", err)
-		}
+	partFn := outFn + ".part"
+	newf, err := os.Create(partFn)
+	if err != nil {
+		return err
+	}
 
-		rsp, err := http.Get(escapedUrl)
-		if err != nil {
-			return err
+	_, err = io.Copy(newf, rsp.Body)
+	if err != nil {
+		newf.Close()
+		return err
+	}
+
+	err = newf.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(partFn, outFn)
+	if err != nil {
+		return err
+	}
+
+	if conditional {
+		return writeDownloadMeta(outFn, downloadMeta{
+			URL:          url,
+			ETag:         rsp.Header.Get("ETag"),
+			LastModified: rsp.Header.Get("Last-Modified"),
+		})
+	}
+
+	return nil
+}
+
+// ensureDownloaded makes sure that the distfile for
+// mirrorRelativeURL exists and matches fileSize and sha512sum
+// (if given), downloading it from repo's mirrors if necessary.
+//
+// Once setup.ini of repo has been loaded, the mirror it came
+// from is tried first. Other mirrors are only used if their
+// setup.ini is at least as new, so that a lagging mirror can't
+// serve an outdated package.
+//
+// With -cache-dir, distfiles with a known sha512sum are shared
+// between runs through the cache.
+func ensureDownloaded(repo *Repository, mirrorRelativeURL string, fileSize int64, sha512sum string) error {
+	if Args.CacheDir != "" && len(sha512sum) > 0 {
+		return ensureDownloadedViaCache(repo, mirrorRelativeURL, fileSize, sha512sum)
+	}
+	_, err := downloadFromMirrors(repo, repo.PreferredMirrors(), mirrorRelativeURL, fileSize, sha512sum)
+	return err
+}
+
+// downloadFromMirrors is like ensureDownloaded, but tries the
+// given mirrors in order, and returns the mirror that the
+// distfile was downloaded from, if any.
+func downloadFromMirrors(repo *Repository, mirrors []string, mirrorRelativeURL string, fileSize int64, sha512sum string) (string, error) {
+	if len(sha512sum) > 0 && fileSize == -1 {
+		return "", errors.New("If ensureDownloaded is passed a sha512sum, it must also be passed a fileSize.")
+	}
+
+	outFn := repo.DistfilePath(mirrorRelativeURL)
+
+	// Reuse a previously downloaded or seeded copy
+	// if it is still intact.
+	if len(sha512sum) > 0 {
+		if absFn, ok := repo.findDistfile(mirrorRelativeURL, fileSize, sha512sum); ok {
+			repo.setFilePath(mirrorRelativeURL, absFn)
+			return "", nil
 		}
-		defer rsp.Body.Close()
+	}
 
-		newf, err := os.Create(outFn)
-		if err != nil {
-			return err
+	for _, mirrorBase := range mirrors {
+		if !repo.IsFreshMirror(mirrorBase) {
+			continue
 		}
-		defer newf.Close()
 
-		_, err = io.Copy(newf, rsp.Body)
+		absFn := outFn
+		var err error
+		if isBundleMirror(mirrorBase) {
+			err = activeBundle.Fetch(repo.DistfileName(mirrorRelativeURL), outFn)
+		} else if dir, ok := localMirrorDir(mirrorBase); ok {
+			absFn, err = fetchFromLocalMirror(dir, mirrorRelativeURL, outFn)
+		} else {
+			err = downloadFromMirror(mirrorBase, mirrorRelativeURL, outFn)
+		}
 		if err != nil {
-			return err
+			log.Printf("mirror '%v' failed: %v", mirrorBase, err)
+			continue
 		}
 
-		if len(sha512sum) == 0 {
-			return nil
-		} else {
-			if fileSize == -1 {
-				return errors.New("If ensureDownloaded is passed a sha512sum, it must also be passed a fileSize.")
+		if len(sha512sum) > 0 {
+			err = checkSHA512(absFn, fileSize, sha512sum)
+			if err != nil {
+				mirrorReport.Inconsistent(mirrorBase, mirrorRelativeURL, err)
+				continue
 			}
-			return checkSHA512(outFn, fileSize, sha512sum)
 		}
+
+		repo.setFilePath(mirrorRelativeURL, absFn)
+		return mirrorBase, nil
 	}
 
-	panic("unreachable")
+	return "", errors.New("no remaining mirrors")
 }
 
 func prepareTarget(targetDir string) error {
@@ -138,54 +251,228 @@ func prepareTarget(targetDir string) error {
 	return nil
 }
 
-func main() {
-	err := ParseArgs()
+// fetchSetupIni downloads a setup.ini variant of repo and its
+// signature from the same mirror, and returns that mirror and
+// variant. If no mirror has one, it uses a setup.ini and
+// signature from the -distfiles directories, with no mirror.
+//
+// The compressed variants are a fallback for mirrors that don't
+// have a plain setup.ini, such as setup.exe's local package
+// directories, or whose plain setup.ini has no signature, such
+// as the one exposed by the serve command. Only once no variant
+// of a mirror has a signature is the next mirror tried.
+func fetchSetupIni(repo *Repository) (string, string, error) {
+	err := errors.New("no remaining mirrors")
+	for _, candidate := range repo.Mirrors {
+		for _, variant := range setupIniVariants {
+			var mirror string
+			mirror, err = downloadFromMirrors(repo, []string{candidate}, Args.Arch+"/"+variant, -1, "")
+			if err != nil {
+				continue
+			}
+
+			log.Printf("fetching %v.sig from mirror '%v'", variant, mirror)
+			_, err = downloadFromMirrors(repo, []string{mirror}, Args.Arch+"/"+variant+".sig", -1, "")
+			if err != nil {
+				err = fmt.Errorf("unable to download %v.sig: %v", variant, err)
+				log.Printf("%v", err)
+				continue
+			}
+
+			return mirror, variant, nil
+		}
+	}
+
+	// Fall back to a setup.ini left in the -distfiles
+	// directories, such as a read-only seed, so that a run
+	// can be done offline.
+	for _, variant := range setupIniVariants {
+		if repo.findSetupIni(variant) {
+			log.Printf("using %v of repository '%v' from '%v'", variant, repo, repo.FilePath(Args.Arch+"/"+variant))
+			return "", variant, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("unable to download setup.ini: %v", err)
+}
+
+// loadRepository fetches the setup.ini of repo and its
+// signature, verifies the signature and parses setup.ini.
+func loadRepository(repo *Repository) (*Distribution, error) {
+	log.Printf("fetching setup.ini from repository '%v'", repo)
+	mirror, variant, err := fetchSetupIni(repo)
 	if err != nil {
-		log.Fatalf("unable to parse args: %v", err)
+		return nil, err
 	}
 
-	if !Args.FetchOnly {
-		log.Printf("preparing target '%v'", Args.Target)
-		err = prepareTarget(Args.Target)
+	log.Printf("verifying %v.sig from repository '%v'", variant, repo)
+	err = verifySetupIniSignature(repo, Args.Arch+"/"+variant)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify setup.ini signature: %v", err)
+	}
+
+	repo.setupIniVariant = variant
+	if variant != "setup.ini" {
+		setupIniPath := repo.DistfilePath(Args.Arch + "/setup.ini")
+		// The decompressed setup.ini doesn't come from a
+		// mirror, so it must not be revalidated against one.
+		os.Remove(setupIniPath + downloadMetaSuffix)
+		err = decompressSetupIniVariant(repo.FilePath(Args.Arch+"/"+variant), setupIniPath)
 		if err != nil {
-			log.Fatalf("prepareTarget failed: %v", err)
+			return nil, fmt.Errorf("unable to decompress %v: %v", variant, err)
 		}
+		repo.setFilePath(Args.Arch+"/setup.ini", setupIniPath)
+	}
+
+	log.Printf("reading setup.ini from repository '%v'", repo)
+	dist, err := parseSetupIni(repo, Args.Arch+"/setup.ini")
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse setup.ini: %v", err)
+	}
+
+	err = validateSetupIniHeader(dist, Args.Arch)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkSetupIniFreshness(repo, dist)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a setup-timestamp, which -allow-rollback accepts,
+	// the zero time treats all mirrors as fresh.
+	ts, _ := dist.Timestamp()
+	repo.SetSetupIniSource(mirror, ts)
+
+	return dist, nil
+}
+
+// loadDistribution prepares the distfiles directory and
+// loads all repositories, merging them into a single
+// distribution.
+func loadDistribution() (*Distribution, error) {
+	layers := Args.DistfilesLayers()
+	for _, dir := range layers[:len(layers)-1] {
+		log.Printf("using read-only distfiles '%v'", dir)
 	}
 
 	log.Printf("preparing distfiles '%v'", Args.Distfiles())
-	err = os.MkdirAll(Args.Distfiles(), 0755)
+	err := os.MkdirAll(Args.Distfiles(), 0755)
 	if os.IsExist(err) {
 		// OK...
 	} else if err != nil {
-		log.Fatalf("unable to prepare distfiles: %v", err)
+		return nil, fmt.Errorf("unable to prepare distfiles: %v", err)
+	}
+
+	mirrors, err := selectMirrors()
+	if err != nil {
+		return nil, fmt.Errorf("unable to select mirrors: %v", err)
+	}
+	Args.selectedMirrors = mirrors
+
+	repos, err := loadRepositories()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load repositories: %v", err)
+	}
+
+	if Args.LocalPackageDir != "" {
+		for _, repo := range repos {
+			if repo.Name != defaultRepositoryName {
+				continue
+			}
+			log.Printf("scanning local package directory '%v'", Args.LocalPackageDir)
+			err = useLocalPackageDir(repo, Args.LocalPackageDir)
+			if err != nil {
+				return nil, fmt.Errorf("unable to use local package directory: %v", err)
+			}
+		}
 	}
 
-	log.Printf("fetching setup.ini")
-	err = ensureDownloaded(Args.Arch+"/setup.ini", -1, "")
+	if Args.Bundle != "" {
+		log.Printf("opening bundle '%v'", Args.Bundle)
+		err = useBundle(repos)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use bundle: %v", err)
+		}
+	}
+
+	dists := []*Distribution{}
+	for _, repo := range repos {
+		dist, err := loadRepository(repo)
+		if err != nil {
+			return nil, fmt.Errorf("repository '%v': %v", repo, err)
+		}
+		dists = append(dists, dist)
+	}
+
+	merged, err := mergeDistributions(repos, dists)
 	if err != nil {
-		log.Fatalf("unable to download setup.ini: %v", err)
+		return nil, err
 	}
+	merged.Repositories = repos
+	return merged, nil
+}
 
-	log.Printf("fetching setup.ini.sig")
-	err = ensureDownloaded(Args.Arch+"/setup.ini.sig", -1, "")
+func main() {
+	err := ParseArgs()
 	if err != nil {
-		log.Fatalf("unable to downlaod setup.ini.sig: %v", err)
+		log.Fatalf("unable to parse args: %v", err)
+	}
+
+	if Args.Command != "" {
+		err = commands[Args.Command].Run(Args.CommandArgs)
+		if err != nil {
+			log.Fatalf("%v failed: %v", Args.Command, err)
+		}
+		return
+	}
+
+	if !Args.FetchOnly {
+		log.Printf("preparing target '%v'", Args.Target)
+		err = prepareTarget(Args.Target)
+		if err != nil {
+			log.Fatalf("prepareTarget failed: %v", err)
+		}
 	}
 
-	log.Printf("verifying setup.ini.sig")
-	err = verifySetupIniSignature(Args.Arch + "/setup.ini")
+	dist, err := loadDistribution()
 	if err != nil {
-		log.Fatalf("unable to verify setup.ini signature: %v", err)
+		log.Fatalf("%v", err)
 	}
 
-	log.Printf("reading setup.ini")
-	dist, err := parseSetupIni(Args.Arch + "/setup.ini")
+	pkgs, err := requestedPackages(dist)
 	if err != nil {
-		log.Fatalf("unable to parse setup.ini: %v", err)
+		log.Fatalf("unable to expand package list: %v", err)
+	}
+
+	excludes := Args.Excludes()
+	if len(excludes) > 0 {
+		kept := []string{}
+		for _, pkg := range pkgs {
+			if isExcluded(pkg, excludes) {
+				log.Printf("not installing excluded package '%v'", pkg)
+				if Args.ProvideExcluded {
+					dist.MarkAsProvided(pkg)
+				}
+				continue
+			}
+			unmet := excludedDependencies(dist, pkg, excludes)
+			if len(unmet) > 0 {
+				log.Printf("package '%v' has unmet dependencies: %v", pkg, strings.Join(unmet, ", "))
+				if Args.ProvideExcluded {
+					for _, req := range unmet {
+						dist.MarkAsProvided(req)
+					}
+				}
+			}
+			kept = append(kept, pkg)
+		}
+		pkgs = kept
 	}
 
 	// Install all requested packages.
-	for _, pkg := range Args.Packages() {
+	for _, pkg := range pkgs {
 		log.Printf("installing package '%v'", pkg)
 		err = installPkg(pkg, dist, Args.Target, nil)
 		if err == ErrAlreadyInstalled {
@@ -195,9 +482,17 @@ func main() {
 		}
 	}
 
-	err = postSetup(Args.Target)
-	if err != nil {
-		log.Fatalf("unable to perform postSetup: %v", err)
+	if !Args.FetchOnly {
+		err = postSetup(Args.Target, dist)
+		if err != nil {
+			log.Fatalf("unable to perform postSetup: %v", err)
+		}
+	}
+
+	mirrorReport.Print()
+
+	if extractSavings.Files > 0 {
+		log.Printf("path filters skipped %v files, saving %v bytes", extractSavings.Files, extractSavings.Bytes)
 	}
 
 	if !Args.KeepDistfiles {
@@ -0,0 +1,132 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// copyFile copies the file at src to dst, creating the parent
+// directory of dst if necessary.
+func copyFile(src string, dst string) error {
+	err := ensureParentDirExists(dst)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// pruneDistribution returns a copy of dist that keeps its
+// header, but only the packages in keep.
+func pruneDistribution(dist *Distribution, keep map[string]bool) *Distribution {
+	pruned := NewDistribution()
+	pruned.Arch = dist.Arch
+	pruned.Comments = dist.Comments
+	for _, pkg := range dist.Packages {
+		name := pkg.Name()
+		if name == "__root__" || keep[name] {
+			pruned.Packages = append(pruned.Packages, pkg)
+		}
+	}
+	return pruned
+}
+
+func runMirror(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one output directory argument, got %v", len(args))
+	}
+	outDir := args[0]
+
+	if Args.SigningKey == "" {
+		return fmt.Errorf("missing argument: signing-key")
+	}
+
+	signer, err := readSigningKey(Args.SigningKey)
+	if err != nil {
+		return fmt.Errorf("unable to read signing key: %v", err)
+	}
+
+	dist, err := loadDistribution()
+	if err != nil {
+		return err
+	}
+
+	pkgs, err := requestedPackages(dist)
+	if err != nil {
+		return err
+	}
+
+	closure, missing := resolveClosure(dist, pkgs, Args.Excludes())
+	if len(missing) > 0 {
+		return fmt.Errorf("no such packages: %v", strings.Join(missing, ", "))
+	}
+
+	keep := make(map[string]bool)
+	for _, name := range closure {
+		pkg, err := dist.Get(name)
+		if err != nil {
+			return err
+		}
+
+		keep[name] = true
+
+		relativeUrl, fileSize, sha512sum := pkg.InstallInfo()
+		if relativeUrl == "" {
+			continue
+		}
+
+		log.Printf("mirroring package '%v'", name)
+		err = ensureDownloaded(pkg.Repo, relativeUrl, fileSize, sha512sum)
+		if err != nil {
+			return err
+		}
+
+		err = copyFile(pkg.Repo.FilePath(relativeUrl), filepath.Join(outDir, filepath.FromSlash(relativeUrl)))
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("writing setup.ini with %v packages", len(closure))
+	setupIniPath := filepath.Join(outDir, Args.Arch, "setup.ini")
+	err = writeSetupIniFile(setupIniPath, pruneDistribution(dist, keep))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("signing setup.ini")
+	err = signFile(signer, setupIniPath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("done")
+	return nil
+}
@@ -0,0 +1,312 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorProbeConcurrency is the number of mirrors probed at
+// the same time.
+const mirrorProbeConcurrency = 8
+
+// mirrorProbeBytes is the number of bytes of setup.ini
+// requested when probing a mirror. It is enough to cover the
+// setup.ini header.
+const mirrorProbeBytes = 4096
+
+// mirrorListEntry is a mirror from Cygwin's mirrors.lst.
+type mirrorListEntry struct {
+	URL     string
+	Host    string
+	Region  string
+	Country string
+}
+
+// parseMirrorList parses a mirrors.lst file, which has one
+// mirror per line, as url;host;region;country.
+func parseMirrorList(r io.Reader) ([]mirrorListEntry, error) {
+	entries := []mirrorListEntry{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ";")
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("malformed mirror list line: %v", line)
+		}
+		if len(fields) > 4 && fields[4] == "noshow" {
+			continue
+		}
+		entries = append(entries, mirrorListEntry{
+			URL:     strings.TrimRight(fields[0], "/"),
+			Host:    fields[1],
+			Region:  fields[2],
+			Country: fields[3],
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// openURLOrFile opens location, which is either an http(s) URL
+// or a local file.
+func openURLOrFile(location string) (io.ReadCloser, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		req, err := newHTTPRequest(http.MethodGet, location)
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := doHTTPRequest(req, Args.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		if rsp.StatusCode != http.StatusOK {
+			rsp.Body.Close()
+			return nil, fmt.Errorf("unable to fetch %v: %v", location, rsp.Status)
+		}
+		return rsp.Body, nil
+	}
+	return os.Open(location)
+}
+
+// filterMirrorList returns the URLs of the entries that use
+// one of protocols and are in one of regions, which match
+// either the region or the country of a mirror. An empty list
+// of regions matches all mirrors.
+func filterMirrorList(entries []mirrorListEntry, protocols []string, regions []string) []string {
+	urls := []string{}
+	for _, entry := range entries {
+		protocolOK := false
+		for _, protocol := range protocols {
+			if strings.HasPrefix(entry.URL, protocol+"://") {
+				protocolOK = true
+				break
+			}
+		}
+		if !protocolOK {
+			continue
+		}
+
+		regionOK := len(regions) == 0
+		for _, region := range regions {
+			if strings.EqualFold(region, entry.Region) || strings.EqualFold(region, entry.Country) {
+				regionOK = true
+				break
+			}
+		}
+		if !regionOK {
+			continue
+		}
+
+		urls = append(urls, entry.URL)
+	}
+	return urls
+}
+
+// mirrorProbe is the result of probing a mirror.
+type mirrorProbe struct {
+	Mirror    string
+	Latency   time.Duration
+	Timestamp time.Time
+	Err       error
+}
+
+// probeMirror requests the start of the setup.ini of mirror,
+// measuring the time to the first byte of the response and
+// reading the setup-timestamp from the setup.ini header.
+func probeMirror(mirror string) mirrorProbe {
+	probe := mirrorProbe{Mirror: mirror}
+
+	if dir, ok := localMirrorDir(mirror); ok {
+		return probeLocalMirror(dir, probe)
+	}
+
+	req, err := newHTTPRequest(http.MethodGet, mirror+"/"+Args.Arch+"/setup.ini")
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%v", mirrorProbeBytes-1))
+
+	start := time.Now()
+	rsp, err := doHTTPRequest(req, Args.ProbeTimeout)
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+	defer rsp.Body.Close()
+	probe.Latency = time.Since(start)
+
+	if rsp.StatusCode != http.StatusOK && rsp.StatusCode != http.StatusPartialContent {
+		probe.Err = fmt.Errorf("unexpected status: %v", rsp.Status)
+		return probe
+	}
+
+	header, err := parseSetupIniHeader(io.LimitReader(rsp.Body, mirrorProbeBytes))
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+
+	dist := NewDistribution()
+	dist.Packages = append(dist.Packages, header)
+	probe.Timestamp, probe.Err = dist.Timestamp()
+	return probe
+}
+
+// probeLocalMirror is probeMirror for local mirrors.
+func probeLocalMirror(dir string, probe mirrorProbe) mirrorProbe {
+	start := time.Now()
+	var f io.ReadCloser
+	var err error
+	for _, variant := range setupIniVariants {
+		f, err = openSetupIniVariant(filepath.Join(dir, Args.Arch, variant))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+	defer f.Close()
+	probe.Latency = time.Since(start)
+
+	header, err := parseSetupIniHeader(io.LimitReader(f, mirrorProbeBytes))
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+
+	dist := NewDistribution()
+	dist.Packages = append(dist.Packages, header)
+	probe.Timestamp, probe.Err = dist.Timestamp()
+	return probe
+}
+
+// probeMirrors probes mirrors concurrently and returns the
+// results in the same order as mirrors.
+func probeMirrors(mirrors []string) []mirrorProbe {
+	probes := make([]mirrorProbe, len(mirrors))
+
+	sem := make(chan bool, mirrorProbeConcurrency)
+	var wg sync.WaitGroup
+	for i, mirror := range mirrors {
+		wg.Add(1)
+		go func(i int, mirror string) {
+			defer wg.Done()
+			sem <- true
+			probes[i] = probeMirror(mirror)
+			<-sem
+		}(i, mirror)
+	}
+	wg.Wait()
+
+	return probes
+}
+
+// selectMirrors returns the ordered list of mirrors to use for
+// the default repository.
+//
+// The candidates are the mirrors given via -mirrors, followed
+// by the mirrors from -mirror-list that match -mirror-protocols
+// and -mirror-regions. With -probe-mirrors, the candidates are
+// probed, those that are unreachable are dropped, and the rest
+// is ordered by the setup-timestamp of their setup.ini, newest
+// first, and then by latency.
+//
+// Probed timestamps aren't verified, so they only decide the
+// order in which mirrors are tried. A mirror that claims a newer
+// setup.ini than it has fails the signature check when setup.ini
+// is loaded, and stale mirrors are refused by the freshness
+// checks against the verified setup.ini.
+func selectMirrors() ([]string, error) {
+	candidates := []string{}
+	seen := make(map[string]bool)
+	add := func(mirror string) {
+		if mirror == "" || seen[mirror] {
+			return
+		}
+		seen[mirror] = true
+		candidates = append(candidates, mirror)
+	}
+
+	for _, mirror := range strings.Split(Args.MirrorsSeparated, ",") {
+		add(strings.TrimRight(mirror, "/"))
+	}
+
+	if Args.MirrorList != "" {
+		log.Printf("reading mirror list '%v'", Args.MirrorList)
+		r, err := openURLOrFile(Args.MirrorList)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseMirrorList(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, mirror := range filterMirrorList(entries, splitList(Args.MirrorProtocols), splitList(Args.MirrorRegions)) {
+			add(mirror)
+		}
+	}
+
+	if !Args.ProbeMirrors {
+		return candidates, nil
+	}
+
+	log.Printf("probing %v mirrors", len(candidates))
+	probes := probeMirrors(candidates)
+
+	newest := time.Time{}
+	for _, probe := range probes {
+		if probe.Err == nil && probe.Timestamp.After(newest) {
+			newest = probe.Timestamp
+		}
+	}
+
+	current := []mirrorProbe{}
+	for _, probe := range probes {
+		if probe.Err != nil {
+			log.Printf("skipping mirror '%v': %v", probe.Mirror, probe.Err)
+			continue
+		}
+		if probe.Timestamp.Before(newest) {
+			log.Printf("mirror '%v' may be stale (%v < %v), trying it last", probe.Mirror, probe.Timestamp.UTC(), newest.UTC())
+		}
+		current = append(current, probe)
+	}
+
+	if len(current) == 0 {
+		return nil, fmt.Errorf("none of the %v probed mirrors is usable", len(candidates))
+	}
+
+	sort.SliceStable(current, func(i, j int) bool {
+		if !current[i].Timestamp.Equal(current[j].Timestamp) {
+			return current[i].Timestamp.After(current[j].Timestamp)
+		}
+		return current[i].Latency < current[j].Latency
+	})
+
+	mirrors := []string{}
+	for _, probe := range current {
+		log.Printf("mirror '%v': %v (setup-timestamp %v)", probe.Mirror, probe.Latency, probe.Timestamp.UTC())
+		mirrors = append(mirrors, probe.Mirror)
+	}
+	return mirrors, nil
+}
@@ -0,0 +1,264 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"github.com/ulikunitz/xz"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// addFileToTar writes the file at absFn to tw as name.
+func addFileToTar(tw *tar.Writer, absFn string, name string, fi os.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Uid = 0
+	hdr.Gid = 0
+	hdr.Uname = ""
+	hdr.Gname = ""
+
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(absFn)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// packDirectory writes the contents of srcDir to absFn as a
+// Cygwin package archive (.tar.xz). If postinstall is not
+// empty, that script is added as etc/postinstall/<name>.sh.
+func packDirectory(srcDir string, name string, postinstall string, absFn string) error {
+	err := ensureParentDirExists(absFn)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(absFn)
+	if err != nil {
+		return err
+	}
+
+	xzw, err := xz.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	tw := tar.NewWriter(xzw)
+
+	err = filepath.Walk(srcDir, func(absPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, absPath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			rel += "/"
+		} else if !fi.Mode().IsRegular() {
+			return fmt.Errorf("unsupported file type: %v", absPath)
+		}
+		return addFileToTar(tw, absPath, rel, fi)
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if postinstall != "" {
+		fi, err := os.Stat(postinstall)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = addFileToTar(tw, postinstall, path.Join("etc", "postinstall", name+".sh"), fi)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = xzw.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// newRepositoryDistribution returns an empty distribution
+// with the header fields of a setup.ini for arch.
+func newRepositoryDistribution(arch string) *Distribution {
+	dist := NewDistribution()
+	dist.Arch = arch
+	root := Package{Meta: map[string]interface{}{"name": "__root__"}}
+	root.Set("", "release", "cygwin")
+	root.Set("", "arch", arch)
+	root.Set("", "setup-timestamp", "0")
+	dist.Packages = append(dist.Packages, root)
+	return dist
+}
+
+// previousVersionFields are the fields of a package version
+// that are kept in the [prev] section when a new version is
+// packed.
+var previousVersionFields = []string{"version", "install", "source", "requires"}
+
+// keepAsPrevious replaces the [prev] section of pkg with its
+// current version, which is about to be replaced. The current
+// version's source is dropped, as pack doesn't create source
+// archives for the new version.
+func keepAsPrevious(pkg *Package) {
+	for _, field := range append([]Field{}, pkg.Fields...) {
+		if field.Section == "prev" {
+			pkg.Unset(field.Section, field.Key)
+		}
+	}
+	for _, key := range previousVersionFields {
+		if val, ok := pkg.Meta[key]; ok {
+			pkg.Set("prev", key, val)
+		}
+	}
+	pkg.Unset("", "source")
+}
+
+func runPack(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one source directory argument, got %v", len(args))
+	}
+	srcDir := args[0]
+
+	if Args.PackName == "" {
+		return fmt.Errorf("missing argument: pack-name")
+	}
+	if Args.PackVersion == "" || !strings.Contains(Args.PackVersion, "-") {
+		return fmt.Errorf("invalid argument: pack-version must be of the form version-release")
+	}
+	if Args.PackRepo == "" {
+		return fmt.Errorf("missing argument: pack-repo")
+	}
+
+	relativeUrl := path.Join(Args.Arch, "release", Args.PackName, Args.PackName+"-"+Args.PackVersion+".tar.xz")
+	absFn := filepath.Join(Args.PackRepo, filepath.FromSlash(relativeUrl))
+
+	log.Printf("packing '%v' into '%v'", srcDir, absFn)
+	err := packDirectory(srcDir, Args.PackName, Args.PackPostinstall, absFn)
+	if err != nil {
+		return err
+	}
+
+	fileSize, sha512sum, err := fileSHA512(absFn)
+	if err != nil {
+		return err
+	}
+
+	setupIniPath := filepath.Join(Args.PackRepo, Args.Arch, "setup.ini")
+	var dist *Distribution
+	if _, err := os.Stat(setupIniPath); err == nil {
+		dist, err = parseSetupIniFile(setupIniPath)
+		if err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		dist = newRepositoryDistribution(Args.Arch)
+	} else {
+		return err
+	}
+
+	pkg := dist.Lookup(Args.PackName)
+	if pkg == nil {
+		log.Printf("adding package '%v' to '%v'", Args.PackName, setupIniPath)
+		dist.Packages = append(dist.Packages, Package{Meta: map[string]interface{}{"name": Args.PackName}})
+		pkg = &dist.Packages[len(dist.Packages)-1]
+	} else if pkg.Version() != Args.PackVersion {
+		log.Printf("updating package '%v' in '%v', keeping version %v as previous version", Args.PackName, setupIniPath, pkg.Version())
+		keepAsPrevious(pkg)
+	} else {
+		log.Printf("updating package '%v' in '%v'", Args.PackName, setupIniPath)
+	}
+
+	if Args.PackSdesc != "" {
+		pkg.Set("", "sdesc", Args.PackSdesc)
+	}
+	if Args.PackCategory != "" {
+		pkg.Set("", "category", strings.Split(Args.PackCategory, ","))
+	}
+	if Args.PackRequires != "" {
+		pkg.Set("", "requires", splitList(Args.PackRequires))
+	} else if flagGiven("pack-requires") {
+		pkg.Unset("", "requires")
+	}
+	pkg.Set("", "version", Args.PackVersion)
+	pkg.Set("", "install", []string{relativeUrl, strconv.FormatInt(fileSize, 10), sha512sum})
+
+	if root := dist.Lookup("__root__"); root != nil {
+		root.Set("", "setup-timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	}
+
+	err = writeSetupIniFile(setupIniPath, dist)
+	if err != nil {
+		return err
+	}
+
+	if Args.SigningKey == "" {
+		// An old signature no longer matches the new setup.ini.
+		err = os.Remove(setupIniPath + ".sig")
+		if err == nil {
+			log.Printf("removed stale setup.ini.sig, use -signing-key to sign setup.ini")
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		log.Printf("signing setup.ini")
+		signer, err := readSigningKey(Args.SigningKey)
+		if err != nil {
+			return fmt.Errorf("unable to read signing key: %v", err)
+		}
+		err = signFile(signer, setupIniPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("done")
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPackOverMultiSectionStanza(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	repoDir := filepath.Join(dir, "repo")
+	err = os.MkdirAll(filepath.Join(srcDir, "usr", "bin"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(srcDir, "usr", "bin", "mytool"), []byte("#!/bin/sh\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupIniPath := filepath.Join(repoDir, "x86", "setup.ini")
+	err = os.MkdirAll(filepath.Dir(setupIniPath), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupIni := strings.Replace(multiSectionSetupIni, "category: Devel\n", "category: Devel\nrequires: bash\n", 1)
+	setupIni = strings.Replace(setupIni, "188 aa\n", "188 aa\nsource: x86/release/mytool/mytool-1.3-1-src.tar.xz 100 dd\n", 1)
+	err = ioutil.WriteFile(setupIniPath, []byte(setupIni), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Args
+	defer func() {
+		Args = saved
+	}()
+	Args.Arch = "x86"
+	Args.SigningKey = ""
+	Args.PackName = "mytool"
+	Args.PackVersion = "1.5-1"
+	Args.PackRepo = repoDir
+	Args.PackSdesc = "My new tool"
+	Args.PackCategory = ""
+	Args.PackPostinstall = ""
+	// An explicitly empty -pack-requires clears the dependencies.
+	// flag.Set also marks the flag as given, which can't be
+	// undone, so restore the flag set as a whole.
+	savedFlags := flag.CommandLine
+	defer func() {
+		flag.CommandLine = savedFlags
+	}()
+	flag.CommandLine = flag.NewFlagSet(savedFlags.Name(), flag.ContinueOnError)
+	savedFlags.VisitAll(func(f *flag.Flag) {
+		flag.CommandLine.Var(f.Value, f.Name, f.Usage)
+	})
+	err = flag.Set("pack-requires", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runPack([]string{srcDir})
+	if err != nil {
+		t.Fatalf("pack failed: %v", err)
+	}
+
+	buf, err := ioutil.ReadFile(setupIniPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), "[]") {
+		t.Fatalf("written setup.ini has an empty section header:\n%s", buf)
+	}
+
+	pkg := parseSetupIniString(t, string(buf)).Lookup("mytool")
+	if pkg == nil {
+		t.Fatalf("package missing from written setup.ini:\n%s", buf)
+	}
+	want := map[string]interface{}{
+		"sdesc":        "My new tool",
+		"version":      "1.5-1",
+		"prevversion":  "1.3-1",
+		"previnstall":  []string{"x86/release/mytool/mytool-1.3-1.tar.xz", "188", "aa"},
+		"prevsource":   []string{"x86/release/mytool/mytool-1.3-1-src.tar.xz", "100", "dd"},
+		"prevrequires": "bash",
+		"testversion":  "1.4-1",
+	}
+	for key, val := range want {
+		if !reflect.DeepEqual(pkg.Meta[key], val) {
+			t.Errorf("%v: got %v, want %v", key, pkg.Meta[key], val)
+		}
+	}
+	for _, key := range []string{"requires", "source"} {
+		if val, ok := pkg.Meta[key]; ok {
+			t.Errorf("%v: got %v, want none", key, val)
+		}
+	}
+	install, ok := pkg.Meta["install"].([]string)
+	if !ok || install[0] != "x86/release/mytool/mytool-1.5-1.tar.xz" {
+		t.Errorf("install: got %v", pkg.Meta["install"])
+	}
+}
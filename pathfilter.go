@@ -0,0 +1,115 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// extractPresets are named sets of exclude rules that can be
+// selected via -extract-preset.
+//
+// nolocale drops the translations of all locales; those given
+// via -extract-locales are kept.
+var extractPresets = map[string][]string{
+	"nodocs": {
+		"usr/share/doc",
+		"usr/share/gtk-doc",
+		"usr/share/info",
+		"usr/share/man",
+	},
+	"nolocale": {
+		"usr/share/locale",
+	},
+}
+
+// pathFilter decides which archive members extractTo writes
+// to the target.
+//
+// Rules are glob patterns (as understood by path.Match) that
+// are matched against the member's path within the archive.
+// A rule that matches a directory also matches everything
+// below it. Include rules take precedence over exclude rules,
+// so that, for example, a single locale can be kept while the
+// rest of usr/share/locale is dropped.
+type pathFilter struct {
+	Includes []string
+	Excludes []string
+}
+
+// localeIncludes returns the include rules that keep the
+// translations of locales, which are glob patterns such as de or
+// pt_*, when they are dropped by the nolocale preset.
+func localeIncludes(locales []string) []string {
+	rules := []string{}
+	for _, locale := range locales {
+		if locale == "" {
+			continue
+		}
+		rules = append(rules, path.Join("usr/share/locale", locale))
+	}
+	return rules
+}
+
+func newPathFilter(includes []string, excludes []string, presets []string) (*pathFilter, error) {
+	filter := &pathFilter{}
+	for _, rule := range includes {
+		if rule == "" {
+			continue
+		}
+		if _, err := path.Match(rule, ""); err != nil {
+			return nil, fmt.Errorf("bad include rule '%v': %v", rule, err)
+		}
+		filter.Includes = append(filter.Includes, strings.Trim(rule, "/"))
+	}
+	for _, rule := range excludes {
+		if rule == "" {
+			continue
+		}
+		if _, err := path.Match(rule, ""); err != nil {
+			return nil, fmt.Errorf("bad exclude rule '%v': %v", rule, err)
+		}
+		filter.Excludes = append(filter.Excludes, strings.Trim(rule, "/"))
+	}
+	for _, preset := range presets {
+		if preset == "" {
+			continue
+		}
+		rules, ok := extractPresets[preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown extract preset: %v", preset)
+		}
+		filter.Excludes = append(filter.Excludes, rules...)
+	}
+	return filter, nil
+}
+
+func matchesRule(rules []string, name string) bool {
+	name = strings.Trim(name, "/")
+	for name != "" && name != "." {
+		for _, rule := range rules {
+			if matched, _ := path.Match(rule, name); matched {
+				return true
+			}
+		}
+		name = path.Dir(name)
+	}
+	return false
+}
+
+// Skip reports whether the archive member name should not be
+// extracted.
+func (filter *pathFilter) Skip(name string) bool {
+	if filter == nil || len(filter.Excludes) == 0 {
+		return false
+	}
+	if matchesRule(filter.Includes, name) {
+		return false
+	}
+	return matchesRule(filter.Excludes, name)
+}
@@ -31,11 +31,21 @@ func configureEtcNsswitch(targetDir string) error {
 	return nil
 }
 
-func postSetup(targetDir string) error {
+func postSetup(targetDir string, dist *Distribution) error {
 	err := configureEtcNsswitch(targetDir)
 	if err != nil {
 		return err
 	}
 
+	err = writeInstalledDb(targetDir, dist)
+	if err != nil {
+		return err
+	}
+
+	err = writeProvenanceDb(targetDir, dist)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,87 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimitChunks is the number of reads per second that a rate
+// limited download is split into, so that the limit is applied
+// smoothly rather than in bursts.
+const rateLimitChunks = 10
+
+// rateLimiter limits the combined rate of all reads that wait
+// on it to rate bytes per second.
+type rateLimiter struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+var (
+	downloadLimiterOnce sync.Once
+	// downloadLimiter limits all downloads to -max-rate.
+	downloadLimiter *rateLimiter
+)
+
+// chunk returns the maximum number of bytes to read at once.
+func (l *rateLimiter) chunk() int {
+	n := l.rate / rateLimitChunks
+	if n < 1 {
+		return 1
+	}
+	return int(n)
+}
+
+// wait blocks until n more bytes can be read without exceeding
+// the rate of l.
+func (l *rateLimiter) wait(n int) {
+	if n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// rateLimitedReader is an io.ReadCloser whose reads are limited
+// by a rateLimiter.
+type rateLimitedReader struct {
+	io.ReadCloser
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if chunk := r.limiter.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
+
+// limitDownload returns body limited to -max-rate, if given.
+func limitDownload(body io.ReadCloser) io.ReadCloser {
+	if Args.MaxRate <= 0 {
+		return body
+	}
+	downloadLimiterOnce.Do(func() {
+		downloadLimiter = &rateLimiter{rate: Args.MaxRate}
+	})
+	return &rateLimitedReader{ReadCloser: body, limiter: downloadLimiter}
+}
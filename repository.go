@@ -0,0 +1,260 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRepositoryName is the name of the repository formed
+// by -mirrors, which is trusted via the embedded Cygwin key.
+const defaultRepositoryName = "cygwin"
+
+// Repository is a package repository: a set of mirrors that
+// all serve the same setup.ini, signed by a trusted key.
+type Repository struct {
+	Name         string
+	Mirrors      []string
+	Keyring      openpgp.EntityList
+	Fingerprints []string
+	Priority     int
+
+	mu               sync.Mutex
+	pooledMirrors    bool
+	setupIniVariant  string
+	setupMirror      string
+	setupTimestamp   time.Time
+	mirrorTimestamps map[string]time.Time
+	localFiles       map[string]string
+}
+
+// DistfileName returns the name of the distfile for the
+// mirror-relative URL relativeUrl, relative to the distfiles
+// directory.
+//
+// Distfiles of the default repository are stored directly in
+// the distfiles directory. Distfiles of other repositories are
+// stored under repos/<name>, so that they can't clash.
+func (repo *Repository) DistfileName(relativeUrl string) string {
+	if repo.Name == defaultRepositoryName {
+		return relativeUrl
+	}
+	return path.Join("repos", repo.Name, relativeUrl)
+}
+
+// DistfilePath returns the path of the distfile for the
+// mirror-relative URL relativeUrl in the writable distfiles
+// directory.
+func (repo *Repository) DistfilePath(relativeUrl string) string {
+	return distfilePath(filepath.FromSlash(repo.DistfileName(relativeUrl)))
+}
+
+// findDistfile returns the path of an existing distfile for the
+// mirror-relative URL relativeUrl that matches fileSize and
+// sha512sum, looking through all -distfiles directories in
+// order.
+func (repo *Repository) findDistfile(relativeUrl string, fileSize int64, sha512sum string) (string, bool) {
+	name := filepath.FromSlash(repo.DistfileName(relativeUrl))
+	for _, dir := range Args.DistfilesLayers() {
+		absFn := filepath.Join(dir, name)
+		if _, err := os.Stat(absFn); err != nil {
+			continue
+		}
+		if checkSHA512(absFn, fileSize, sha512sum) == nil {
+			return absFn, true
+		}
+	}
+	return "", false
+}
+
+// findSetupIni looks for the setup.ini variant of repo and its
+// signature in the -distfiles directories, in order, and makes
+// repo use the first pair that it finds. It reports whether it
+// found one. The signature is verified as usual when the
+// repository is loaded.
+func (repo *Repository) findSetupIni(variant string) bool {
+	relativeUrl := Args.Arch + "/" + variant
+	name := filepath.FromSlash(repo.DistfileName(relativeUrl))
+	for _, dir := range Args.DistfilesLayers() {
+		absFn := filepath.Join(dir, name)
+		if _, err := os.Stat(absFn); err != nil {
+			continue
+		}
+		if _, err := os.Stat(absFn + ".sig"); err != nil {
+			continue
+		}
+		repo.setFilePath(relativeUrl, absFn)
+		repo.setFilePath(relativeUrl+".sig", absFn+".sig")
+		return true
+	}
+	return false
+}
+
+func (repo *Repository) String() string {
+	return repo.Name
+}
+
+// parseRepositorySpec parses a repository given via -repo, in
+// the form name=<name>,url=<url>,key=<file>[,fingerprint=<fp>][,priority=<n>].
+// The url, key and fingerprint keys can be given more than once.
+func parseRepositorySpec(spec string) (*Repository, error) {
+	repo := &Repository{}
+	keyFiles := []string{}
+
+	for _, kv := range strings.Split(spec, ",") {
+		eq := strings.Index(kv, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("bad repository '%v': expected key=value, got '%v'", spec, kv)
+		}
+		key, value := kv[:eq], kv[eq+1:]
+		switch key {
+		case "name":
+			repo.Name = value
+		case "url":
+			repo.Mirrors = append(repo.Mirrors, strings.TrimRight(value, "/"))
+		case "key":
+			keyFiles = append(keyFiles, value)
+		case "fingerprint":
+			repo.Fingerprints = append(repo.Fingerprints, value)
+		case "priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad repository '%v': bad priority '%v'", spec, value)
+			}
+			repo.Priority = priority
+		default:
+			return nil, fmt.Errorf("bad repository '%v': unknown key '%v'", spec, key)
+		}
+	}
+
+	if repo.Name == "" || repo.Name == "." || repo.Name == ".." || strings.ContainsAny(repo.Name, `/\:`) {
+		return nil, fmt.Errorf("bad repository '%v': missing or invalid name", spec)
+	}
+	if repo.Name == defaultRepositoryName {
+		return nil, fmt.Errorf("bad repository '%v': name '%v' is reserved for -mirrors", spec, repo.Name)
+	}
+	if len(repo.Mirrors) == 0 {
+		return nil, fmt.Errorf("bad repository '%v': missing url", spec)
+	}
+	if len(keyFiles) == 0 {
+		return nil, fmt.Errorf("bad repository '%v': missing key", spec)
+	}
+
+	for _, keyFile := range keyFiles {
+		keyring, err := readKeyringFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("bad repository '%v': unable to read key: %v", spec, err)
+		}
+		repo.Keyring = append(repo.Keyring, keyring...)
+	}
+
+	return repo, nil
+}
+
+// loadRepositories returns the default repository and all
+// repositories given via -repo, ordered by priority, highest
+// first. Repositories of equal priority keep the order in
+// which they were given, after the default repository.
+func loadRepositories() ([]*Repository, error) {
+	keyring := openpgp.EntityList{}
+	if len(Args.Keyrings) == 0 {
+		embedded, err := readKeyring([]byte(cygwinPubring))
+		if err != nil {
+			return nil, err
+		}
+		keyring = embedded
+	}
+	for _, keyFile := range Args.Keyrings {
+		keys, err := readKeyringFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read keyring '%v': %v", keyFile, err)
+		}
+		keyring = append(keyring, keys...)
+	}
+
+	repos := []*Repository{{
+		Name:         defaultRepositoryName,
+		Mirrors:      Args.Mirrors(),
+		Keyring:      keyring,
+		Fingerprints: Args.TrustedFingerprints,
+		Priority:     0,
+	}}
+
+	seen := map[string]bool{defaultRepositoryName: true}
+	for _, spec := range Args.Repositories {
+		repo, err := parseRepositorySpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if seen[repo.Name] {
+			return nil, fmt.Errorf("duplicate repository: %v", repo.Name)
+		}
+		seen[repo.Name] = true
+		repos = append(repos, repo)
+	}
+
+	sort.SliceStable(repos, func(i, j int) bool {
+		return repos[i].Priority > repos[j].Priority
+	})
+
+	return repos, nil
+}
+
+// mergeDistributions merges dists, loaded from repos and ordered
+// by the priority of their repositories, highest first, into a
+// single distribution. A package in a higher priority repository
+// shadows packages of the same name in lower priority
+// repositories.
+//
+// The header, including setup-timestamp, is taken from the
+// default repository, if any, rather than from whichever
+// repository has the highest priority. All repositories must be
+// for the same arch.
+func mergeDistributions(repos []*Repository, dists []*Distribution) (*Distribution, error) {
+	merged := NewDistribution()
+	if len(dists) == 0 {
+		return merged, nil
+	}
+
+	header := dists[0]
+	for i, dist := range dists {
+		if dist.Arch != header.Arch {
+			return nil, fmt.Errorf("repository '%v' is for arch '%v', but repository '%v' is for arch '%v'", repos[i], dist.Arch, repos[0], header.Arch)
+		}
+		if repos[i].Name == defaultRepositoryName {
+			header = dist
+		}
+	}
+	merged.Arch = header.Arch
+	merged.Comments = header.Comments
+
+	seen := make(map[string]bool)
+	if root := header.Lookup("__root__"); root != nil {
+		merged.Packages = append(merged.Packages, *root)
+	}
+	seen["__root__"] = true
+
+	for _, dist := range dists {
+		for _, pkg := range dist.Packages {
+			name := pkg.Name()
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			merged.Packages = append(merged.Packages, pkg)
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// categoryPrefix marks an entry in the package list as a
+// category selector rather than a package name. For example,
+// "@Base" selects every package in the Base category.
+const categoryPrefix = "@"
+
+// expandPackageList expands the category selectors in names
+// against the category fields of dist, and returns the
+// resulting list of package names.
+//
+// Package names are returned in the order they were selected,
+// with duplicates removed.
+func expandPackageList(dist *Distribution, names []string) ([]string, error) {
+	seen := make(map[string]bool)
+	expanded := []string{}
+
+	add := func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		expanded = append(expanded, name)
+	}
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.HasPrefix(name, categoryPrefix) {
+			category := name[len(categoryPrefix):]
+			members := dist.PackagesInCategory(category)
+			if len(members) == 0 {
+				return nil, fmt.Errorf("no packages in category: %v", category)
+			}
+			for _, member := range members {
+				add(member)
+			}
+			continue
+		}
+		add(name)
+	}
+
+	return expanded, nil
+}
+
+// isExcluded reports whether name matches any of the
+// glob patterns in excludes.
+func isExcluded(name string, excludes []string) bool {
+	for _, pattern := range excludes {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedDependencies returns the sorted names of all
+// packages that name transitively depends on, but which
+// are dropped from its closure by excludes.
+func excludedDependencies(dist *Distribution, name string, excludes []string) []string {
+	visited := make(map[string]bool)
+	unmet := make(map[string]bool)
+
+	var walk func(name string)
+	walk = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+
+		pkg, err := dist.Get(name)
+		if err != nil {
+			// Missing packages are reported by installPkg.
+			return
+		}
+
+		for _, req := range pkg.Requirements() {
+			if strings.HasPrefix(req, "_") {
+				// Skip internal hint
+				continue
+			}
+			if isExcluded(req, excludes) {
+				unmet[req] = true
+				continue
+			}
+			walk(req)
+		}
+	}
+	walk(name)
+
+	names := []string{}
+	for req := range unmet {
+		names = append(names, req)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveClosure returns the sorted names of the packages in
+// names and everything they transitively depend on, leaving
+// out packages that match excludes. Packages that are not in
+// dist are returned separately in missing.
+func resolveClosure(dist *Distribution, names []string, excludes []string) (closure []string, missing []string) {
+	visited := make(map[string]bool)
+
+	var walk func(name string)
+	walk = func(name string) {
+		if visited[name] || isExcluded(name, excludes) {
+			return
+		}
+		visited[name] = true
+
+		pkg, err := dist.Get(name)
+		if err != nil {
+			missing = append(missing, name)
+			return
+		}
+		closure = append(closure, name)
+
+		for _, req := range pkg.Requirements() {
+			if strings.HasPrefix(req, "_") {
+				// Skip internal hint
+				continue
+			}
+			walk(req)
+		}
+	}
+
+	for _, name := range names {
+		walk(name)
+	}
+
+	sort.Strings(closure)
+	sort.Strings(missing)
+	return closure, missing
+}
+
+// requestedPackages returns the expanded list of packages
+// requested via -packages and -include-base.
+func requestedPackages(dist *Distribution) ([]string, error) {
+	requested := Args.Packages()
+	if Args.IncludeBase {
+		requested = append([]string{categoryPrefix + "Base"}, requested...)
+	}
+	return expandPackageList(dist, requested)
+}
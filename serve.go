@@ -0,0 +1,278 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorServer serves a distfiles directory or a bundle over
+// HTTP in the standard mirror layout. Distfiles of repositories
+// other than the default one are served below repos/<name>/.
+//
+// With an upstream mirror, misses are fetched from upstream and
+// cached in dir, and setup.ini is refreshed from upstream on
+// every request, falling back to the cached copy. Cached files
+// are not verified; clients verify them as they would for any
+// other mirror.
+type mirrorServer struct {
+	dir      string
+	bundle   *bundle
+	upstream string
+
+	// locks holds a lock per path, so that concurrent
+	// fetches of a file don't clobber each other. A
+	// setup.ini and its signature share a lock.
+	locksMu sync.Mutex
+	locks   map[string]*sync.RWMutex
+}
+
+// serveStagingSuffix is appended to the names of setup.ini files
+// and signatures while they are being refreshed from upstream.
+const serveStagingSuffix = ".new"
+
+// lock returns the lock of rel.
+func (s *mirrorServer) lock(rel string) *sync.RWMutex {
+	if isSetupIniFile(rel) {
+		rel = strings.TrimSuffix(rel, ".sig")
+	}
+
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	if s.locks == nil {
+		s.locks = make(map[string]*sync.RWMutex)
+	}
+	l, ok := s.locks[rel]
+	if !ok {
+		l = &sync.RWMutex{}
+		s.locks[rel] = l
+	}
+	return l
+}
+
+// path returns the path of rel in the directory of s.
+func (s *mirrorServer) path(rel string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(rel))
+}
+
+// validPath reports whether rel, a cleaned slash-separated
+// request path, names a file within the directory of s. Like
+// http.Dir, it refuses backslashes and colons, which Windows
+// treats as separators and drive letters, and ".." elements.
+func (s *mirrorServer) validPath(rel string) bool {
+	if strings.ContainsAny(rel, "\\:") {
+		return false
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(filepath.Clean(filepath.FromSlash(rel))), "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	within, err := filepath.Rel(filepath.Clean(s.dir), s.path(rel))
+	return err == nil && within != ".." && !strings.HasPrefix(within, ".."+string(filepath.Separator))
+}
+
+// serveFile serves rel from the directory of s, and reports
+// whether it exists.
+func (s *mirrorServer) serveFile(w http.ResponseWriter, r *http.Request, rel string) bool {
+	f, err := os.Open(s.path(rel))
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	return true
+}
+
+// serveBundle serves rel from the bundle of s, and reports
+// whether it exists.
+func (s *mirrorServer) serveBundle(w http.ResponseWriter, r *http.Request, rel string) bool {
+	if s.bundle == nil || rel == bundleManifestName || rel == bundleManifestSigName {
+		return false
+	}
+	entry, ok := s.bundle.entries[rel]
+	if !ok {
+		return false
+	}
+	http.ServeContent(w, r, path.Base(rel), time.Time{}, s.bundle.section(entry))
+	return true
+}
+
+// fetch downloads rel from the upstream mirror of s into its
+// directory.
+func (s *mirrorServer) fetch(rel string) error {
+	l := s.lock(rel)
+	l.Lock()
+	defer l.Unlock()
+
+	log.Printf("fetching '%v' from upstream '%v'", rel, s.upstream)
+	return downloadFromMirror(s.upstream, rel, s.path(rel))
+}
+
+// refreshSetupIni refreshes the setup.ini variant rel and its
+// signature from the upstream mirror of s as one unit: both are
+// downloaded next to the cached copies first, and only replace
+// them once both downloads succeeded, so that a setup.ini is
+// never served with the signature of another one.
+func (s *mirrorServer) refreshSetupIni(rel string) error {
+	l := s.lock(rel)
+	l.Lock()
+	defer l.Unlock()
+
+	log.Printf("refreshing '%v' from upstream '%v'", rel, s.upstream)
+	pair := []string{rel, rel + ".sig"}
+	for _, member := range pair {
+		absFn := s.path(member)
+		stagingFn := absFn + serveStagingSuffix
+		defer os.Remove(stagingFn)
+		defer os.Remove(stagingFn + downloadMetaSuffix)
+
+		// Start from the cached copy, so that a conditional
+		// GET can leave it unchanged. The metadata is
+		// rewritten in place, so it must not be linked.
+		if meta, err := ioutil.ReadFile(absFn + downloadMetaSuffix); err == nil {
+			err = linkOrCopy(absFn, stagingFn)
+			if err == nil {
+				err = ioutil.WriteFile(stagingFn+downloadMetaSuffix, meta, 0644)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		err := downloadFromMirror(s.upstream, member, stagingFn)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, member := range pair {
+		absFn := s.path(member)
+		stagingFn := absFn + serveStagingSuffix
+		err := os.Rename(stagingFn, absFn)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(stagingFn+downloadMetaSuffix, absFn+downloadMetaSuffix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveSetupIni serves the setup.ini variant or signature rel,
+// refreshing setup.ini variants and their signatures from
+// upstream first. Signatures are only fetched if missing, as
+// they are refreshed along with their setup.ini, which clients
+// fetch first.
+func (s *mirrorServer) serveSetupIni(w http.ResponseWriter, r *http.Request, rel string) bool {
+	if s.upstream != "" {
+		base := strings.TrimSuffix(rel, ".sig")
+		_, err := os.Stat(s.path(rel))
+		if base == rel || err != nil {
+			err = s.refreshSetupIni(base)
+			if err != nil {
+				log.Printf("unable to refresh '%v' from upstream: %v", base, err)
+			}
+		}
+	}
+
+	l := s.lock(rel)
+	l.RLock()
+	defer l.RUnlock()
+	return s.serveBundle(w, r, rel) || s.serveFile(w, r, rel)
+}
+
+func (s *mirrorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%v %v %v", r.RemoteAddr, r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	rel := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if rel == "" || !s.validPath(rel) || strings.HasSuffix(rel, ".part") || strings.HasSuffix(rel, downloadMetaSuffix) || strings.HasSuffix(rel, serveStagingSuffix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if isSetupIniFile(rel) {
+		if !s.serveSetupIni(w, r, rel) {
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	if s.serveBundle(w, r, rel) || s.serveFile(w, r, rel) {
+		return
+	}
+
+	if s.upstream != "" {
+		err := s.fetch(rel)
+		if err != nil {
+			log.Printf("unable to fetch '%v' from upstream: %v", rel, err)
+		} else if s.serveFile(w, r, rel) {
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+func runServe(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one distfiles directory or bundle argument, got %v", len(args))
+	}
+
+	fi, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+
+	s := &mirrorServer{dir: args[0], upstream: strings.TrimSuffix(Args.Upstream, "/")}
+	if !fi.IsDir() {
+		repos, err := loadRepositories()
+		if err != nil {
+			return fmt.Errorf("unable to load repositories: %v", err)
+		}
+
+		trust, err := bundleTrust(repos)
+		if err != nil {
+			return err
+		}
+
+		s.bundle, err = openBundle(args[0], trust)
+		if err != nil {
+			return fmt.Errorf("unable to open bundle: %v", err)
+		}
+
+		// Misses fetched from upstream can't be added
+		// to the bundle, so they go to distfiles.
+		s.dir = Args.Distfiles()
+	}
+
+	log.Printf("serving '%v' on %v", args[0], Args.Listen)
+	return http.ListenAndServe(Args.Listen, s)
+}
@@ -7,25 +7,37 @@ package main
 
 import (
 	"bufio"
+	"compress/bzip2"
 	"errors"
 	"fmt"
+	"github.com/ulikunitz/xz"
 	"io"
+	"log"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Distribution struct {
 	Arch     string
+	Comments []string
 	Packages []Package
 
+	// Repositories are the repositories that the
+	// distribution was loaded from, if any.
+	Repositories []*Repository
+
 	InstalledPackages map[string]bool
+	ProvidedPackages  map[string]bool
 }
 
 func NewDistribution() *Distribution {
 	d := new(Distribution)
 	d.Packages = make([]Package, 0)
 	d.InstalledPackages = make(map[string]bool)
+	d.ProvidedPackages = make(map[string]bool)
 	return d
 }
 
@@ -38,6 +50,53 @@ func (dist *Distribution) Get(name string) (Package, error) {
 	return Package{}, fmt.Errorf("no such package: %v", name)
 }
 
+// Lookup returns a pointer to the package called name, for
+// modifying it in place, or nil if there is no such package.
+func (dist *Distribution) Lookup(name string) *Package {
+	for i := range dist.Packages {
+		if dist.Packages[i].Name() == name {
+			return &dist.Packages[i]
+		}
+	}
+	return nil
+}
+
+// Header returns the value of the header field key, such as
+// "arch" or "setup-timestamp", or "" if it isn't set.
+func (dist *Distribution) Header(key string) string {
+	root, err := dist.Get("__root__")
+	if err != nil {
+		return ""
+	}
+	if val, ok := root.Meta[key].(string); ok {
+		return val
+	}
+	return ""
+}
+
+// Timestamp returns the setup-timestamp header field.
+func (dist *Distribution) Timestamp() (time.Time, error) {
+	val := dist.Header("setup-timestamp")
+	if val == "" {
+		return time.Time{}, errors.New("missing setup-timestamp")
+	}
+	secs, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed setup-timestamp '%v'", val)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+func (dist *Distribution) PackagesInCategory(category string) []string {
+	names := []string{}
+	for _, pkg := range dist.Packages {
+		if pkg.InCategory(category) {
+			names = append(names, pkg.Name())
+		}
+	}
+	return names
+}
+
 func (dist *Distribution) IsInstalled(name string) bool {
 	if _, ok := dist.InstalledPackages[name]; ok {
 		return true
@@ -49,8 +108,80 @@ func (dist *Distribution) MarkAsInstalled(name string) {
 	dist.InstalledPackages[name] = true
 }
 
+// MarkAsProvided marks a package as provided externally.
+// The package is treated as installed, but none of its
+// files are extracted into the target.
+func (dist *Distribution) MarkAsProvided(name string) {
+	dist.InstalledPackages[name] = true
+	dist.ProvidedPackages[name] = true
+}
+
+func (dist *Distribution) IsProvided(name string) bool {
+	if _, ok := dist.ProvidedPackages[name]; ok {
+		return true
+	}
+	return false
+}
+
 type Package struct {
-	Meta map[string]interface{}
+	Meta   map[string]interface{}
+	Fields []Field
+	Repo   *Repository
+}
+
+// Field records a field of a package stanza in setup.ini, in
+// the order it appeared in, so that the stanza can be written
+// back out as it was read.
+type Field struct {
+	Section string
+	Key     string
+	Quoted  bool
+}
+
+// quotedFields are the fields that setup.ini always quotes.
+var quotedFields = map[string]bool{
+	"sdesc":   true,
+	"ldesc":   true,
+	"message": true,
+}
+
+// Set sets the field key in section to value. A field that
+// isn't already present is added at the end of the fields of
+// its section, which for the "" section is before any of the
+// [prev] and [test] sections.
+func (pkg *Package) Set(section string, key string, value interface{}) {
+	if _, ok := pkg.Meta[section+key]; !ok {
+		at := len(pkg.Fields)
+		if section == "" {
+			at = 0
+		}
+		for i, field := range pkg.Fields {
+			if field.Section == section {
+				at = i + 1
+			}
+		}
+		field := Field{
+			Section: section,
+			Key:     key,
+			Quoted:  quotedFields[key],
+		}
+		pkg.Fields = append(pkg.Fields[:at], append([]Field{field}, pkg.Fields[at:]...)...)
+	}
+	pkg.Meta[section+key] = value
+}
+
+// Unset removes the field key in section, if present.
+func (pkg *Package) Unset(section string, key string) {
+	if _, ok := pkg.Meta[section+key]; !ok {
+		return
+	}
+	delete(pkg.Meta, section+key)
+	for i, field := range pkg.Fields {
+		if field.Section == section && field.Key == key {
+			pkg.Fields = append(pkg.Fields[:i], pkg.Fields[i+1:]...)
+			break
+		}
+	}
 }
 
 func (pkg *Package) Name() string {
@@ -60,6 +191,19 @@ func (pkg *Package) Name() string {
 	return ""
 }
 
+func (pkg *Package) Version() string {
+	if version, ok := pkg.Meta["version"]; ok {
+		if v, ok := version.(string); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// Requirements returns the names of the packages that pkg
+// depends on, from its requires field, or from its depends2
+// field if it has no requires field. Version constraints in
+// depends2 are ignored.
 func (pkg *Package) Requirements() []string {
 	if reqs, ok := pkg.Meta["requires"]; ok {
 		switch v := reqs.(type) {
@@ -69,9 +213,45 @@ func (pkg *Package) Requirements() []string {
 			return []string{v}
 		}
 	}
+
+	deps := ""
+	switch v := pkg.Meta["depends2"].(type) {
+	case []string:
+		deps = strings.Join(v, " ")
+	case string:
+		deps = v
+	}
+	reqs := []string{}
+	for _, dep := range strings.Split(deps, ",") {
+		// Drop version constraints such as "(>= 1.0)".
+		if fields := strings.Fields(dep); len(fields) > 0 {
+			reqs = append(reqs, fields[0])
+		}
+	}
+	return reqs
+}
+
+func (pkg *Package) Categories() []string {
+	if cats, ok := pkg.Meta["category"]; ok {
+		switch v := cats.(type) {
+		case []string:
+			return v
+		case string:
+			return []string{v}
+		}
+	}
 	return []string{}
 }
 
+func (pkg *Package) InCategory(category string) bool {
+	for _, cat := range pkg.Categories() {
+		if strings.EqualFold(cat, category) {
+			return true
+		}
+	}
+	return false
+}
+
 func (pkg *Package) InstallInfo() (relativeUrl string, fileSize int64, sha512sum string) {
 	if val, ok := pkg.Meta["install"]; ok {
 		info := val.([]string)
@@ -89,9 +269,147 @@ func (pkg *Package) InstallInfo() (relativeUrl string, fileSize int64, sha512sum
 	return "", -1, ""
 }
 
-func parseSetupIni(setupIniRelativeURL string) (*Distribution, error) {
-	setupIniPath := distfilePath(setupIniRelativeURL)
+// parseSetupIni parses the setup.ini of repo, recording repo
+// as the origin of each package.
+func parseSetupIni(repo *Repository, setupIniRelativeURL string) (*Distribution, error) {
+	dist, err := parseSetupIniFile(repo.FilePath(setupIniRelativeURL))
+	if err != nil {
+		return nil, err
+	}
+	for i := range dist.Packages {
+		dist.Packages[i].Repo = repo
+	}
+	return dist, nil
+}
+
+// setupIniVariants are the file names that setup.ini is
+// published under on mirrors, in order of preference. The
+// compressed variants are signed in their compressed form.
+var setupIniVariants = []string{"setup.ini", "setup.xz", "setup.bz2"}
+
+// isSetupIniFile reports whether the mirror-relative path rel
+// is a setup.ini variant or its signature.
+func isSetupIniFile(rel string) bool {
+	base := strings.TrimSuffix(path.Base(rel), ".sig")
+	for _, variant := range setupIniVariants {
+		if base == variant {
+			return true
+		}
+	}
+	return false
+}
+
+// openSetupIniVariant opens the setup.ini variant at path,
+// decompressing it if necessary.
+func openSetupIniVariant(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".xz") {
+		r, err = xz.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else if strings.HasSuffix(path, ".bz2") {
+		r = bzip2.NewReader(f)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
 
+// decompressSetupIniVariant writes the decompressed setup.ini
+// variant at path to outFn.
+func decompressSetupIniVariant(path string, outFn string) error {
+	r, err := openSetupIniVariant(path)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	err = ensureParentDirExists(outFn)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(outFn)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, r)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// knownReleases are the release names that setup.ini can
+// declare in its header.
+var knownReleases = map[string]bool{
+	"cygwin": true,
+}
+
+// validateSetupIniHeader checks that the header of dist is for
+// arch, declares a known release, and doesn't require a newer
+// setup.ini format than cygwin-bootstrap supports.
+func validateSetupIniHeader(dist *Distribution, arch string) error {
+	if dist.Arch != arch {
+		return fmt.Errorf("setup.ini is for arch '%v', want '%v'", dist.Arch, arch)
+	}
+
+	if release := dist.Header("release"); release != "" && !knownReleases[release] {
+		return fmt.Errorf("setup.ini is for unknown release '%v'", release)
+	}
+
+	if minVersion := dist.Header("setup-minimum-version"); minVersion != "" {
+		if compareVersions(minVersion, setupIniFormatVersion) > 0 {
+			if !Args.IgnoreMinVersion {
+				return fmt.Errorf("this setup.ini requires a newer bootstrapper: setup-minimum-version is %v, but %v v%v only supports up to %v (use -ignore-minimum-version to try anyway)", minVersion, progName, progVersion, setupIniFormatVersion)
+			}
+			log.Printf("ignoring setup-minimum-version %v, newer than the supported %v", minVersion, setupIniFormatVersion)
+		}
+	}
+
+	return nil
+}
+
+// parseSetupIniHeader reads just the header fields at the
+// start of a setup.ini, and returns them as the __root__
+// package. It stops at the first blank line.
+func parseSetupIniHeader(r io.Reader) (Package, error) {
+	root := Package{Meta: map[string]interface{}{"name": "__root__"}}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "@") {
+			return root, nil
+		}
+		colon := strings.Index(line, ": ")
+		if colon < 0 {
+			return Package{}, errors.New("expected colon")
+		}
+		root.Set("", line[:colon], strings.TrimSpace(line[colon+2:]))
+	}
+	if err := scanner.Err(); err != nil {
+		return Package{}, err
+	}
+	return root, nil
+}
+
+func parseSetupIniFile(setupIniPath string) (*Distribution, error) {
 	f, err := os.Open(setupIniPath)
 	if err != nil {
 		return nil, err
@@ -101,8 +419,36 @@ func parseSetupIni(setupIniRelativeURL string) (*Distribution, error) {
 
 	dist := NewDistribution()
 	meta := make(map[string]interface{})
+	fields := []Field{}
 	prefix := ""
 
+	endStanza := func() {
+		if len(meta) == 0 {
+			return
+		}
+		if _, ok := meta["name"]; !ok {
+			meta["name"] = "__root__"
+		}
+		dist.Packages = append(dist.Packages, Package{
+			Meta:   meta,
+			Fields: fields,
+		})
+		meta = make(map[string]interface{})
+		fields = []Field{}
+		prefix = ""
+	}
+
+	setField := func(key string, value interface{}, quoted bool) {
+		if _, ok := meta[prefix+key]; !ok {
+			fields = append(fields, Field{
+				Section: prefix,
+				Key:     key,
+				Quoted:  quoted,
+			})
+		}
+		meta[prefix+key] = value
+	}
+
 	b := bufio.NewReader(f)
 
 	for {
@@ -119,8 +465,11 @@ func parseSetupIni(setupIniRelativeURL string) (*Distribution, error) {
 
 		line := string(lineBuf) + string("\n")
 
-		// Skip comments
+		// Skip comments, but keep those in the header.
 		if strings.HasPrefix(line, "#") {
+			if len(dist.Packages) == 0 && len(meta) == 0 {
+				dist.Comments = append(dist.Comments, strings.TrimRight(line, "\n"))
+			}
 			continue
 			// Context switch
 		} else if strings.HasPrefix(line, "@") {
@@ -132,14 +481,7 @@ func parseSetupIni(setupIniRelativeURL string) (*Distribution, error) {
 			prefix = trimmedLine[1 : len(trimmedLine)-1]
 			// End context
 		} else if strings.TrimSpace(line) == "" {
-			if _, ok := meta["name"]; !ok {
-				meta["name"] = "__root__"
-			}
-			dist.Packages = append(dist.Packages, Package{
-				Meta: meta,
-			})
-			meta = make(map[string]interface{})
-			prefix = ""
+			endStanza()
 		} else {
 			colon := strings.Index(line, ":")
 			if colon < 0 {
@@ -177,14 +519,18 @@ func parseSetupIni(setupIniRelativeURL string) (*Distribution, error) {
 				}
 				for {
 					c := getch()
-					if c == `"` {
-						if escapeSequence {
-							strLit += `"`
-							escapeSequence = false
-							continue
-						} else {
-							break
+					if escapeSequence {
+						// Only \" and \\ are escape sequences.
+						// Any other backslash is literal.
+						if c != `"` && c != `\` {
+							strLit += `\`
 						}
+						strLit += c
+						escapeSequence = false
+						continue
+					}
+					if c == `"` {
+						break
 					} else if c == `\` {
 						escapeSequence = true
 						continue
@@ -193,17 +539,23 @@ func parseSetupIni(setupIniRelativeURL string) (*Distribution, error) {
 					}
 				}
 				if len(beforeStrLit) > 0 {
-					meta[prefix+key] = []string{beforeStrLit, strLit}
+					setField(key, []string{beforeStrLit, strLit}, true)
 				} else {
-					meta[prefix+key] = strLit
+					setField(key, strLit, true)
 				}
 			} else if strings.Count(value, " ") > 0 { // read list
-				meta[prefix+key] = strings.Split(strings.TrimSpace(value), " ")
+				setField(key, strings.Split(strings.TrimSpace(value), " "), false)
 			} else { // read string
-				meta[prefix+key] = strings.TrimSpace(value)
+				setField(key, strings.TrimSpace(value), false)
 			}
 		}
 	}
 
+	// The last stanza isn't necessarily followed by
+	// a blank line.
+	endStanza()
+
+	dist.Arch = dist.Header("arch")
+
 	return dist, nil
 }
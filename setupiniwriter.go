@@ -0,0 +1,172 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// quoteSetupIniString quotes s for use as a quoted field value
+// in setup.ini.
+//
+// Double quotes are escaped with a backslash. Backslashes are
+// only escaped where parseSetupIni would otherwise read them as
+// the start of an escape sequence, so that upstream files, which
+// don't escape backslashes, are reproduced as they were.
+func quoteSetupIniString(s string) string {
+	quoted := `"`
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted += `\"`
+		case c == '\\' && (i+1 == len(s) || s[i+1] == '"' || s[i+1] == '\\'):
+			quoted += `\\`
+		default:
+			quoted += string(c)
+		}
+	}
+	return quoted + `"`
+}
+
+func formatSetupIniField(field Field, val interface{}) (string, error) {
+	switch v := val.(type) {
+	case string:
+		if field.Quoted {
+			return quoteSetupIniString(v), nil
+		}
+		return v, nil
+	case []string:
+		if field.Quoted {
+			if len(v) != 2 {
+				return "", fmt.Errorf("quoted field '%v' has %v values", field.Key, len(v))
+			}
+			return v[0] + quoteSetupIniString(v[1]), nil
+		}
+		return strings.Join(v, " "), nil
+	}
+	return "", fmt.Errorf("field '%v' has unsupported type %T", field.Key, val)
+}
+
+// writeSetupIniStanza writes the fields of pkg, grouped by
+// section. The fields of the "" section come first, without a
+// section header, followed by the other sections in the order
+// they first appear in.
+func writeSetupIniStanza(w *bufio.Writer, pkg *Package) error {
+	sections := []string{""}
+	for _, field := range pkg.Fields {
+		found := false
+		for _, section := range sections {
+			if section == field.Section {
+				found = true
+			}
+		}
+		if !found {
+			sections = append(sections, field.Section)
+		}
+	}
+
+	for _, section := range sections {
+		header := false
+		for _, field := range pkg.Fields {
+			if field.Section != section {
+				continue
+			}
+			val, ok := pkg.Meta[field.Section+field.Key]
+			if !ok {
+				continue
+			}
+
+			if section != "" && !header {
+				header = true
+				_, err := w.WriteString("[" + section + "]\n")
+				if err != nil {
+					return err
+				}
+			}
+
+			value, err := formatSetupIniField(field, val)
+			if err != nil {
+				return fmt.Errorf("package %v: %v", pkg.Name(), err)
+			}
+
+			_, err = w.WriteString(field.Key + ": " + value + "\n")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeSetupIni writes dist in setup.ini format: the header
+// comments and fields, followed by one stanza per package,
+// each preceded by a blank line.
+func writeSetupIni(out io.Writer, dist *Distribution) error {
+	w := bufio.NewWriter(out)
+
+	for _, comment := range dist.Comments {
+		_, err := w.WriteString(comment + "\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range dist.Packages {
+		pkg := &dist.Packages[i]
+		if pkg.Name() == "__root__" {
+			err := writeSetupIniStanza(w, pkg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := range dist.Packages {
+		pkg := &dist.Packages[i]
+		if pkg.Name() == "__root__" {
+			continue
+		}
+
+		_, err := w.WriteString("\n@ " + pkg.Name() + "\n")
+		if err != nil {
+			return err
+		}
+
+		err = writeSetupIniStanza(w, pkg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// writeSetupIniFile writes dist to the file at path, creating
+// its parent directory if necessary.
+func writeSetupIniFile(path string, dist *Distribution) error {
+	err := ensureParentDirExists(path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = writeSetupIni(f, dist)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
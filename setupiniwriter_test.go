@@ -0,0 +1,126 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const multiSectionSetupIni = `release: cygwin
+arch: x86
+setup-timestamp: 1792372447
+
+@ mytool
+sdesc: "My tool"
+category: Devel
+version: 1.3-1
+install: x86/release/mytool/mytool-1.3-1.tar.xz 188 aa
+[prev]
+version: 1.2-1
+install: x86/release/mytool/mytool-1.2-1.tar.xz 180 bb
+[test]
+version: 1.4-1
+install: x86/release/mytool/mytool-1.4-1.tar.xz 190 cc
+`
+
+// parseSetupIniString parses content as a setup.ini.
+func parseSetupIniString(t *testing.T, content string) *Distribution {
+	dir, err := ioutil.TempDir("", "setupini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "setup.ini")
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dist, err := parseSetupIniFile(path)
+	if err != nil {
+		t.Fatalf("unable to parse setup.ini: %v", err)
+	}
+	return dist
+}
+
+func TestWriteSetupIniRoundTrip(t *testing.T) {
+	dist := parseSetupIniString(t, multiSectionSetupIni)
+
+	var buf bytes.Buffer
+	err := writeSetupIni(&buf, dist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != multiSectionSetupIni {
+		t.Errorf("round trip changed setup.ini:\n%v", buf.String())
+	}
+}
+
+func TestSetAddsFieldToItsSection(t *testing.T) {
+	dist := parseSetupIniString(t, multiSectionSetupIni)
+	pkg := dist.Lookup("mytool")
+	pkg.Set("", "requires", []string{"bash", "coreutils"})
+	pkg.Set("prev", "requires", "bash")
+	pkg.Set("test", "message", "mytool test")
+
+	var buf bytes.Buffer
+	err := writeSetupIni(&buf, dist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := buf.String()
+	if strings.Contains(written, "[]") {
+		t.Fatalf("written setup.ini has an empty section header:\n%v", written)
+	}
+
+	want := strings.Replace(multiSectionSetupIni, "188 aa\n", "188 aa\nrequires: bash coreutils\n", 1)
+	want = strings.Replace(want, "180 bb\n", "180 bb\nrequires: bash\n", 1)
+	want += "message: \"mytool test\"\n"
+	if written != want {
+		t.Fatalf("got:\n%v\nwant:\n%v", written, want)
+	}
+
+	reread := parseSetupIniString(t, written).Lookup("mytool")
+	for _, key := range []string{"requires", "prevrequires", "testmessage", "prevversion", "testversion"} {
+		if !reflect.DeepEqual(reread.Meta[key], pkg.Meta[key]) {
+			t.Errorf("%v: got %v, want %v", key, reread.Meta[key], pkg.Meta[key])
+		}
+	}
+}
+
+func TestWriteSetupIniGroupsSections(t *testing.T) {
+	pkg := Package{
+		Meta: map[string]interface{}{
+			"name":        "mytool",
+			"version":     "1.3-1",
+			"prevversion": "1.2-1",
+			"sdesc":       "My tool",
+		},
+		Fields: []Field{
+			{Section: "", Key: "version"},
+			{Section: "prev", Key: "version"},
+			{Section: "", Key: "sdesc", Quoted: true},
+		},
+	}
+	dist := &Distribution{Packages: []Package{pkg}}
+
+	var buf bytes.Buffer
+	err := writeSetupIni(&buf, dist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\n@ mytool\nversion: 1.3-1\nsdesc: \"My tool\"\n[prev]\nversion: 1.2-1\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%v\nwant:\n%v", buf.String(), want)
+	}
+}
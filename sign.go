@@ -0,0 +1,84 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"os"
+)
+
+// signingKeyPassphraseEnv names the environment variable that
+// holds the passphrase of an encrypted signing key.
+const signingKeyPassphraseEnv = "CYGWIN_BOOTSTRAP_SIGNING_PASSPHRASE"
+
+// readSigningKey reads the first private key from the armored
+// keyring at path, decrypting it if necessary.
+func readSigningKey(path string) (*openpgp.Entity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	keyring, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range keyring {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			passphrase := os.Getenv(signingKeyPassphraseEnv)
+			if passphrase == "" {
+				return nil, fmt.Errorf("signing key is encrypted, but %v is not set", signingKeyPassphraseEnv)
+			}
+			err = entity.PrivateKey.Decrypt([]byte(passphrase))
+			if err != nil {
+				return nil, err
+			}
+			for _, subkey := range entity.Subkeys {
+				if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+					err = subkey.PrivateKey.Decrypt([]byte(passphrase))
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		return entity, nil
+	}
+
+	return nil, errors.New("no private key found in signing key file")
+}
+
+// signFile writes a binary detached signature for the file at
+// path to path + ".sig", in the format used for setup.ini.sig.
+func signFile(signer *openpgp.Entity, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	sig, err := os.Create(path + ".sig")
+	if err != nil {
+		return err
+	}
+
+	err = openpgp.DetachSign(sig, signer, f, nil)
+	if err != nil {
+		sig.Close()
+		return err
+	}
+
+	return sig.Close()
+}
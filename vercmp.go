@@ -0,0 +1,147 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"strings"
+)
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// compareSegments compares two version strings segment by
+// segment, in the style of rpmvercmp, which is also what
+// Cygwin's setup.exe uses for ordering package versions.
+//
+// Runs of digits are compared numerically, runs of letters
+// are compared lexically, and a numeric segment is newer
+// than an alphabetic one. Other characters only separate
+// segments. A tilde sorts before everything, even the end
+// of the string.
+func compareSegments(a string, b string) int {
+	for {
+		// Skip separators.
+		for len(a) > 0 && !isDigit(a[0]) && !isAlpha(a[0]) && a[0] != '~' {
+			a = a[1:]
+		}
+		for len(b) > 0 && !isDigit(b[0]) && !isAlpha(b[0]) && b[0] != '~' {
+			b = b[1:]
+		}
+
+		// Tildes sort before anything else.
+		aTilde := len(a) > 0 && a[0] == '~'
+		bTilde := len(b) > 0 && b[0] == '~'
+		if aTilde || bTilde {
+			if !aTilde {
+				return 1
+			}
+			if !bTilde {
+				return -1
+			}
+			a = a[1:]
+			b = b[1:]
+			continue
+		}
+
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+
+		var aSeg, bSeg string
+		numeric := isDigit(a[0])
+		if numeric {
+			aSeg, a = splitRun(a, isDigit)
+			bSeg, b = splitRun(b, isDigit)
+		} else {
+			aSeg, a = splitRun(a, isAlpha)
+			bSeg, b = splitRun(b, isAlpha)
+		}
+
+		if bSeg == "" {
+			// Segment types differ. Numeric segments
+			// are newer than alphabetic ones.
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			aSeg = strings.TrimLeft(aSeg, "0")
+			bSeg = strings.TrimLeft(bSeg, "0")
+			if len(aSeg) != len(bSeg) {
+				if len(aSeg) > len(bSeg) {
+					return 1
+				}
+				return -1
+			}
+		}
+
+		if c := strings.Compare(aSeg, bSeg); c != 0 {
+			return c
+		}
+	}
+
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	if len(a) == 0 {
+		return -1
+	}
+	return 1
+}
+
+func splitRun(s string, pred func(byte) bool) (run string, rest string) {
+	i := 0
+	for i < len(s) && pred(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// compareVersions compares two Cygwin package versions of
+// the form [epoch:]version-release. It returns -1 if a is older
+// than b, 1 if a is newer than b and 0 if they are equivalent.
+// A missing epoch is the same as an epoch of 0.
+func compareVersions(a string, b string) int {
+	aEpoch, a := splitEpoch(a)
+	bEpoch, b := splitEpoch(b)
+	if c := compareSegments(aEpoch, bEpoch); c != 0 {
+		return c
+	}
+	aVersion, aRelease := splitVersionRelease(a)
+	bVersion, bRelease := splitVersionRelease(b)
+	if c := compareSegments(aVersion, bVersion); c != 0 {
+		return c
+	}
+	return compareSegments(aRelease, bRelease)
+}
+
+func splitEpoch(v string) (epoch string, rest string) {
+	idx := strings.Index(v, ":")
+	if idx <= 0 {
+		return "0", v
+	}
+	for i := 0; i < idx; i++ {
+		if !isDigit(v[i]) {
+			return "0", v
+		}
+	}
+	return v[:idx], v[idx+1:]
+}
+
+func splitVersionRelease(v string) (version string, release string) {
+	idx := strings.LastIndex(v, "-")
+	if idx < 0 {
+		return v, ""
+	}
+	return v[:idx], v[idx+1:]
+}
@@ -0,0 +1,46 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"1.0-1", "1.0-1", 0},
+		{"1.0-1", "1.0-2", -1},
+		{"1.10-1", "1.9-1", 1},
+		{"1.01-1", "1.1-1", 0},
+		{"1.0-1", "1.0.1-1", -1},
+		{"1.0_1-1", "1.0.1-1", 0},
+		{"2.0-1", "2.a-1", 1},
+		{"1.0a-1", "1.0-1", 1},
+		{"1.0a-1", "1.0b-1", -1},
+		{"1.0alpha-1", "1.0beta-1", -1},
+		{"1.0~rc1-1", "1.0-1", -1},
+		{"1.0~rc1-1", "1.0~rc2-1", -1},
+		{"1.0~~-1", "1.0~-1", -1},
+		{"1.0-1~bp1", "1.0-1", -1},
+		{"1:1.0-1", "2.0-1", 1},
+		{"0:2.0-1", "2.0-1", 0},
+		{"1:1.0-1", "2:0.1-1", -1},
+		{"10:1.0-1", "9:1.0-1", 1},
+	}
+
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+		if got := compareVersions(test.b, test.a); got != -test.want {
+			t.Errorf("compareVersions(%q, %q) = %v, want %v", test.b, test.a, got, -test.want)
+		}
+	}
+}
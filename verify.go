@@ -6,12 +6,26 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
 // Cygwin public keyring via https://cygwin.com/key/pubring.asc
+//
+// This is the default keyring for the -mirrors repository.
+// It can be replaced via -keyring.
 var cygwinPubring = `
 -----BEGIN PGP PUBLIC KEY BLOCK-----
 Version: GnuPG v1.2.6 (GNU/Linux)
@@ -39,32 +53,294 @@ opO2jFlwAKCwlu0FsfcO/2+AresM67hCSwxQ+g==
 -----END PGP PUBLIC KEY BLOCK-----
 `
 
-func verifySetupIniSignature(setupIniRelativeURL string) error {
-	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(cygwinPubring))
+// readKeyringFile reads an OpenPGP keyring from the file at
+// path, which can be either armored or binary.
+func readKeyringFile(path string) (openpgp.EntityList, error) {
+	buf, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return readKeyring(buf)
+}
+
+// readKeyring reads an OpenPGP keyring from buf, which can be
+// either armored or binary.
+//
+// openpgp.ReadKeyRing only keeps the first signature that follows
+// a subkey, which is its binding signature, so a revocation of
+// the subkey issued later is lost. readKeyring records such
+// revocations as the Sig of the subkey, where openpgp.ReadKeyRing
+// puts a revocation that comes first.
+func readKeyring(buf []byte) (openpgp.EntityList, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(buf), []byte("-----BEGIN PGP")) {
+		block, err := armor.Decode(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		if block.Type != openpgp.PublicKeyType && block.Type != openpgp.PrivateKeyType {
+			return nil, fmt.Errorf("expected an OpenPGP keyring, got %v", block.Type)
+		}
+		buf, err = ioutil.ReadAll(block.Body)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	setupIniPath := distfilePath(setupIniRelativeURL)
-	f, err := os.Open(setupIniPath)
+	keyring, err := openpgp.ReadKeyRing(bytes.NewReader(buf))
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = recordSubkeyRevocations(keyring, buf)
+	if err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// recordSubkeyRevocations sets the Sig of each subkey in keyring
+// that is revoked by a valid revocation signature in the binary
+// keyring buf to that revocation signature.
+func recordSubkeyRevocations(keyring openpgp.EntityList, buf []byte) error {
+	packets := packet.NewReader(bytes.NewReader(buf))
+	var current *packet.PublicKey
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch pkt := p.(type) {
+		case *packet.PublicKey:
+			current = nil
+			if pkt.IsSubkey {
+				current = pkt
+			}
+		case *packet.PrivateKey:
+			current = nil
+			if pkt.IsSubkey {
+				current = &pkt.PublicKey
+			}
+		case *packet.UserId, *packet.UserAttribute:
+			current = nil
+		case *packet.Signature:
+			if current == nil || pkt.SigType != packet.SigTypeSubkeyRevocation {
+				continue
+			}
+			for _, entity := range keyring {
+				for i := range entity.Subkeys {
+					subkey := &entity.Subkeys[i]
+					if subkey.PublicKey.KeyId != current.KeyId {
+						continue
+					}
+					if entity.PrimaryKey.VerifyKeySignature(subkey.PublicKey, pkt) != nil {
+						continue
+					}
+					subkey.Sig = pkt
+				}
+			}
+		}
+	}
+}
+
+// normalizeFingerprint returns fp as upper case hex, without
+// any spaces or 0x prefix.
+func normalizeFingerprint(fp string) string {
+	fp = strings.Replace(fp, " ", "", -1)
+	fp = strings.TrimPrefix(strings.TrimPrefix(fp, "0x"), "0X")
+	return strings.ToUpper(fp)
+}
+
+func fingerprintString(pk *packet.PublicKey) string {
+	return strings.ToUpper(hex.EncodeToString(pk.Fingerprint[:]))
+}
+
+// keyExpired reports whether the key pk, with the self-signature
+// sig, had expired at time at. Key lifetimes are relative to
+// the creation time of the key itself.
+func keyExpired(pk *packet.PublicKey, sig *packet.Signature, at time.Time) bool {
+	if sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return false
+	}
+	expiry := pk.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+	return at.After(expiry)
+}
+
+// signerIdentity returns a name for entity to use in logs.
+func signerIdentity(entity *openpgp.Entity) string {
+	for _, identity := range entity.Identities {
+		if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return identity.Name
+		}
+	}
+	names := []string{}
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		return names[0]
+	}
+	return entity.PrimaryKey.KeyIdString()
+}
+
+// primarySelfSignature returns the self-signature of the primary
+// identity of entity, or, if no identity is marked as primary,
+// the most recent self-signature of any identity.
+func primarySelfSignature(entity *openpgp.Entity) *packet.Signature {
+	var latest *packet.Signature
+	for _, identity := range entity.Identities {
+		sig := identity.SelfSignature
+		if sig == nil {
+			continue
+		}
+		if sig.IsPrimaryId != nil && *sig.IsPrimaryId {
+			return sig
+		}
+		if latest == nil || sig.CreationTime.After(latest.CreationTime) {
+			latest = sig
+		}
+	}
+	return latest
+}
+
+// checkSigningKey checks that the key with the id issuerKeyId,
+// which made a valid signature at signedAt, belongs to an entity
+// in repo's keyring that is not revoked and had not expired at
+// signedAt, and that matches one of repo's pinned fingerprints,
+// if any.
+func checkSigningKey(repo *Repository, signer *openpgp.Entity, issuerKeyId uint64, signedAt time.Time) error {
+	if len(signer.Revocations) > 0 {
+		return fmt.Errorf("signing key %v has been revoked", fingerprintString(signer.PrimaryKey))
+	}
+
+	if keyExpired(signer.PrimaryKey, primarySelfSignature(signer), signedAt) {
+		return fmt.Errorf("signing key %v has expired", fingerprintString(signer.PrimaryKey))
+	}
+
+	fingerprints := []string{fingerprintString(signer.PrimaryKey)}
+	for _, subkey := range signer.Subkeys {
+		if subkey.PublicKey.KeyId != issuerKeyId {
+			continue
+		}
+		if subkey.Sig != nil && subkey.Sig.SigType == packet.SigTypeSubkeyRevocation {
+			return fmt.Errorf("signing subkey %v has been revoked", fingerprintString(subkey.PublicKey))
+		}
+		if keyExpired(subkey.PublicKey, subkey.Sig, signedAt) {
+			return fmt.Errorf("signing subkey %v has expired", fingerprintString(subkey.PublicKey))
+		}
+		fingerprints = append(fingerprints, fingerprintString(subkey.PublicKey))
+	}
+
+	if len(repo.Fingerprints) == 0 {
+		return nil
+	}
+	for _, pinned := range repo.Fingerprints {
+		for _, fp := range fingerprints {
+			if normalizeFingerprint(pinned) == fp {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("signing key %v does not match any trusted fingerprint", fingerprints[0])
+}
+
+// verifyFileSignature verifies the detached signature in sigPath
+// of the file at path against the keys trusted for repo, and
+// returns the signer.
+func verifyFileSignature(repo *Repository, path string, sigPath string) (*openpgp.Entity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
 
 	defer f.Close()
 
-	setupIniSigPath := distfilePath(setupIniRelativeURL + ".sig")
-	sig, err := os.Open(setupIniSigPath)
+	sig, err := ioutil.ReadFile(sigPath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return verifySignature(repo, f, sig)
+}
+
+// verifySignature verifies the detached signature sig of signed
+// against the keys trusted for repo, and returns the signer.
+func verifySignature(repo *Repository, signed io.Reader, sig []byte) (*openpgp.Entity, error) {
+	issuerKeyId, signedAt, err := signaturePacketToVerify(repo.Keyring, sig)
+	if err != nil {
+		return nil, err
 	}
 
-	defer sig.Close()
+	signer, err := openpgp.CheckDetachedSignature(repo.Keyring, signed, bytes.NewReader(sig))
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = openpgp.CheckDetachedSignature(keyring, f, sig)
+	err = checkSigningKey(repo, signer, issuerKeyId, signedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+// signaturePacketToVerify returns the issuer and creation time of
+// the packet in sig that openpgp.CheckDetachedSignature verifies,
+// which is the first one whose issuer is in keyring. Any other
+// packets in sig are not verified, so their issuers and creation
+// times must not be trusted.
+func signaturePacketToVerify(keyring openpgp.KeyRing, sig []byte) (uint64, time.Time, error) {
+	packets := packet.NewReader(bytes.NewReader(sig))
+	unusable := []uint64{}
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			if len(unusable) > 0 {
+				return 0, time.Time{}, fmt.Errorf("signing key %016X is revoked or not allowed to sign", unusable[0])
+			}
+			return 0, time.Time{}, errors.New("signature isn't made by a trusted key")
+		}
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+
+		var issuerKeyId uint64
+		var signedAt time.Time
+		switch sigPacket := p.(type) {
+		case *packet.Signature:
+			if sigPacket.IssuerKeyId == nil {
+				return 0, time.Time{}, errors.New("signature doesn't have an issuer")
+			}
+			issuerKeyId = *sigPacket.IssuerKeyId
+			signedAt = sigPacket.CreationTime
+		case *packet.SignatureV3:
+			issuerKeyId = sigPacket.IssuerKeyId
+			signedAt = sigPacket.CreationTime
+		default:
+			return 0, time.Time{}, errors.New("not a signature")
+		}
+
+		if len(keyring.KeysByIdUsage(issuerKeyId, packet.KeyFlagSign)) > 0 {
+			return issuerKeyId, signedAt, nil
+		}
+		if len(keyring.KeysById(issuerKeyId)) > 0 {
+			unusable = append(unusable, issuerKeyId)
+		}
+	}
+}
+
+func verifySetupIniSignature(repo *Repository, setupIniRelativeURL string) error {
+	signer, err := verifyFileSignature(repo, repo.FilePath(setupIniRelativeURL), repo.FilePath(setupIniRelativeURL+".sig"))
 	if err != nil {
 		return err
 	}
 
+	log.Printf("setup.ini from repository '%v' signed by %v (fingerprint %v)", repo, signerIdentity(signer), fingerprintString(signer.PrimaryKey))
+
 	return nil
 }
@@ -0,0 +1,155 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"golang.org/x/crypto/openpgp/armor"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// subkeyKeyring has a certification-only primary key and a
+// signing subkey, which made subkeySignature of subkeySigned.
+const subkeyKeyring = `
+-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mI0EatV8zwEEALmkU0lHixa5375rdr+7bETEuWUAr0ayoREsBnhKbSA08tAGQEWD
+Ha8v1Ule6z4IbkyKW6lJw2hUx532w7S7fZGwx5KDqZQtz7D8nYpXj45DX5UXflOp
+E2GLDiciNIt0jqwv8ELeiYwgAUrxQifqmLgwR2nYR/kGBIh7L3X2b2XLABEBAAG0
+IFN1YmtleSBUZXN0IDxzdWJrZXlAZXhhbXBsZS5vcmc+iM4EEwEKADgWIQT73kjJ
+enQ2FNrg5oTZLh+FyI0qVAUCatV8zwIbAQULCQgHAgYVCgkICwIEFgIDAQIeAQIX
+gAAKCRDZLh+FyI0qVGZ1BAC5JeZQ7X7SRBygGF2KiuZm0519bA2ax3TVtDItHQd8
+oLsNPh3gWCSK/fq88q7XfOnabr8JKOmqcGzO0rNDD3Wjg6LEnE2jvtTEAOJNsI8+
+txwGvswU0/MUJP9XLHHmTI2MHWs4pszmnaX+x3ZfwWJONLWO77AJNxh3K7sHz8de
+27iNBGrVfM8BBAC33l29z/Z/ZiLfvbHCGi8XxFD5IvzBcT0qD2PIS/8Z4n5GgXsv
+ZHvr8G3FcihDJrpDVEvtp+stWlDftdM2wBuE5m9iRI5ZDIpBMYpfW+/bOyFimyi8
+Duhc5n8R9f5M2dh6dMhn2x/u8uKa4ti33GeyEu6ecFhp+ElE20Cuf1v+6wARAQAB
+iQFrBBgBCgAgFiEE+95IyXp0NhTa4OaE2S4fhciNKlQFAmrVfM8CGwIAvwkQ2S4f
+hciNKlS0IAQZAQoAHRYhBHdjrapNtfnqZN3wnYbSxw7eyBu8BQJq1XzPAAoJEIbS
+xw7eyBu8vRUD/0JBzYPQeDVk7u3IURcnVK2sk6tHcbGy6JIeyVTUk/diEJcHN/If
+M/ScD+qRtDNVDaZoIWXa50JoSBIAG5umCbf/9tqMgOZM6KSxnTsRvg+o7NYRA0Z4
+Wroq+KRZ8Vm7YMduvvFxVKzzEAJIZCB6NN3zr7iNFjw42D3R+amx7w+LFmAD+wd1
+oSgqVx+/CRKO3q+hvp5m5Vjc0gADfMXzgtxLLLfNQzCV4KD2RQTzlbfCreyyOXHB
+XjFFl8d8kb8XjWbtL0CWpAabGrF0txXKg3hq5iCpA0M+9tzZKpqWVQ5Nf+HtJ33d
+hfZmBtJukgb4jeX0g96CPU5EUf+5CdQK1e1f6TLu
+=P7lI
+-----END PGP PUBLIC KEY BLOCK-----
+`
+
+// subkeyKeyringRevoked is subkeyKeyring with the subkey revoked,
+// as exported by GnuPG, which puts the revocation before the
+// binding signature.
+const subkeyKeyringRevoked = `
+-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mI0EatV8zwEEALmkU0lHixa5375rdr+7bETEuWUAr0ayoREsBnhKbSA08tAGQEWD
+Ha8v1Ule6z4IbkyKW6lJw2hUx532w7S7fZGwx5KDqZQtz7D8nYpXj45DX5UXflOp
+E2GLDiciNIt0jqwv8ELeiYwgAUrxQifqmLgwR2nYR/kGBIh7L3X2b2XLABEBAAG0
+IFN1YmtleSBUZXN0IDxzdWJrZXlAZXhhbXBsZS5vcmc+iM4EEwEKADgWIQT73kjJ
+enQ2FNrg5oTZLh+FyI0qVAUCatV8zwIbAQULCQgHAgYVCgkICwIEFgIDAQIeAQIX
+gAAKCRDZLh+FyI0qVGZ1BAC5JeZQ7X7SRBygGF2KiuZm0519bA2ax3TVtDItHQd8
+oLsNPh3gWCSK/fq88q7XfOnabr8JKOmqcGzO0rNDD3Wjg6LEnE2jvtTEAOJNsI8+
+txwGvswU0/MUJP9XLHHmTI2MHWs4pszmnaX+x3ZfwWJONLWO77AJNxh3K7sHz8de
+27iNBGrVfM8BBAC33l29z/Z/ZiLfvbHCGi8XxFD5IvzBcT0qD2PIS/8Z4n5GgXsv
+ZHvr8G3FcihDJrpDVEvtp+stWlDftdM2wBuE5m9iRI5ZDIpBMYpfW+/bOyFimyi8
+Duhc5n8R9f5M2dh6dMhn2x/u8uKa4ti33GeyEu6ecFhp+ElE20Cuf1v+6wARAQAB
+iL0EKAEKACcWIQT73kjJenQ2FNrg5oTZLh+FyI0qVAUCatV8zwkdAXJldGlyZWQA
+CgkQ2S4fhciNKlSwjgP9EsT5b5E8zexgZtCF7HsmdvMXv5y6OdE1b6F9jbM+Wnyi
+QJylixDELhkxdyY7lXe8lRNYTvLifDSuPfj+tD1RcMRj1EnR5RrM8+cHFGqQcjke
+rjnXzRBEgZvo9bEObxNhnHUE6wD4IqdOhkcsxoLN+/a2QKiX8WNYbXX0NqNzXEuJ
+AWsEGAEKACAWIQT73kjJenQ2FNrg5oTZLh+FyI0qVAUCatV8zwIbAgC/CRDZLh+F
+yI0qVLQgBBkBCgAdFiEEd2Otqk21+epk3fCdhtLHDt7IG7wFAmrVfM8ACgkQhtLH
+Dt7IG7y9FQP/QkHNg9B4NWTu7chRFydUrayTq0dxsbLokh7JVNST92IQlwc38h8z
+9JwP6pG0M1UNpmghZdrnQmhIEgAbm6YJt//22oyA5kzopLGdOxG+D6js1hEDRnha
+uir4pFnxWbtgx26+8XFUrPMQAkhkIHo03fOvuI0WPDjYPdH5qbHvD4sWYAP7B3Wh
+KCpXH78JEo7er6G+nmblWNzSAAN8xfOC3Esst81DMJXgoPZFBPOVt8Kt7LI5ccFe
+MUWXx3yRvxeNZu0vQJakBpsasXS3FcqDeGrmIKkDQz723NkqmpZVDk1/4e0nfd2F
+9mYG0m6SBviN5fSD3oI9TkRR/7kJ1ArV7V/pMu4=
+=vk1Z
+-----END PGP PUBLIC KEY BLOCK-----
+`
+
+// subkeyKeyringRevokedLate is subkeyKeyringRevoked with the
+// revocation after the binding signature.
+const subkeyKeyringRevokedLate = `
+-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mI0EatV8zwEEALmkU0lHixa5375rdr+7bETEuWUAr0ayoREsBnhKbSA08tAGQEWD
+Ha8v1Ule6z4IbkyKW6lJw2hUx532w7S7fZGwx5KDqZQtz7D8nYpXj45DX5UXflOp
+E2GLDiciNIt0jqwv8ELeiYwgAUrxQifqmLgwR2nYR/kGBIh7L3X2b2XLABEBAAG0
+IFN1YmtleSBUZXN0IDxzdWJrZXlAZXhhbXBsZS5vcmc+iM4EEwEKADgWIQT73kjJ
+enQ2FNrg5oTZLh+FyI0qVAUCatV8zwIbAQULCQgHAgYVCgkICwIEFgIDAQIeAQIX
+gAAKCRDZLh+FyI0qVGZ1BAC5JeZQ7X7SRBygGF2KiuZm0519bA2ax3TVtDItHQd8
+oLsNPh3gWCSK/fq88q7XfOnabr8JKOmqcGzO0rNDD3Wjg6LEnE2jvtTEAOJNsI8+
+txwGvswU0/MUJP9XLHHmTI2MHWs4pszmnaX+x3ZfwWJONLWO77AJNxh3K7sHz8de
+27iNBGrVfM8BBAC33l29z/Z/ZiLfvbHCGi8XxFD5IvzBcT0qD2PIS/8Z4n5GgXsv
+ZHvr8G3FcihDJrpDVEvtp+stWlDftdM2wBuE5m9iRI5ZDIpBMYpfW+/bOyFimyi8
+Duhc5n8R9f5M2dh6dMhn2x/u8uKa4ti33GeyEu6ecFhp+ElE20Cuf1v+6wARAQAB
+iQFrBBgBCgAgFiEE+95IyXp0NhTa4OaE2S4fhciNKlQFAmrVfM8CGwIAvwkQ2S4f
+hciNKlS0IAQZAQoAHRYhBHdjrapNtfnqZN3wnYbSxw7eyBu8BQJq1XzPAAoJEIbS
+xw7eyBu8vRUD/0JBzYPQeDVk7u3IURcnVK2sk6tHcbGy6JIeyVTUk/diEJcHN/If
+M/ScD+qRtDNVDaZoIWXa50JoSBIAG5umCbf/9tqMgOZM6KSxnTsRvg+o7NYRA0Z4
+Wroq+KRZ8Vm7YMduvvFxVKzzEAJIZCB6NN3zr7iNFjw42D3R+amx7w+LFmAD+wd1
+oSgqVx+/CRKO3q+hvp5m5Vjc0gADfMXzgtxLLLfNQzCV4KD2RQTzlbfCreyyOXHB
+XjFFl8d8kb8XjWbtL0CWpAabGrF0txXKg3hq5iCpA0M+9tzZKpqWVQ5Nf+HtJ33d
+hfZmBtJukgb4jeX0g96CPU5EUf+5CdQK1e1f6TLuiL0EKAEKACcWIQT73kjJenQ2
+FNrg5oTZLh+FyI0qVAUCatV8zwkdAXJldGlyZWQACgkQ2S4fhciNKlSwjgP9EsT5
+b5E8zexgZtCF7HsmdvMXv5y6OdE1b6F9jbM+WnyiQJylixDELhkxdyY7lXe8lRNY
+TvLifDSuPfj+tD1RcMRj1EnR5RrM8+cHFGqQcjkerjnXzRBEgZvo9bEObxNhnHUE
+6wD4IqdOhkcsxoLN+/a2QKiX8WNYbXX0NqNzXEs=
+=QuHF
+-----END PGP PUBLIC KEY BLOCK-----
+`
+
+const subkeySigned = "signed data\n"
+
+const subkeySignature = `
+-----BEGIN PGP SIGNATURE-----
+
+iLMEAAEKAB0WIQR3Y62qTbX56mTd8J2G0scO3sgbvAUCatV8zwAKCRCG0scO3sgb
+vAJCA/405Wid0gPchY6cRQkKiDeftJROjcy0E9uz0fxSdNV9fcVFMWUwvembvp6Z
+G8bcIyJFgmFZVcHwA+Hc6nlvTGG5OeJx7OS3uzUhnau9QihsJMV0/wvPHqOrdoYj
+yCT8b8RbXVwaCz/2N4qfNsPwC549+P7sN815GjrYiNdSoaKpLg==
+=m2Xs
+-----END PGP SIGNATURE-----
+`
+
+func TestVerifySignatureBySubkey(t *testing.T) {
+	block, err := armor.Decode(strings.NewReader(subkeySignature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keyring string
+		valid   bool
+	}{
+		{"valid", subkeyKeyring, true},
+		{"revoked", subkeyKeyringRevoked, false},
+		{"revoked late", subkeyKeyringRevokedLate, false},
+	}
+
+	for _, test := range tests {
+		keyring, err := readKeyring([]byte(test.keyring))
+		if err != nil {
+			t.Fatalf("%v: unable to read keyring: %v", test.name, err)
+		}
+		repo := &Repository{Keyring: keyring}
+
+		_, err = verifySignature(repo, strings.NewReader(subkeySigned), sig)
+		if test.valid && err != nil {
+			t.Errorf("%v: got %v, want a valid signature", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%v: got a valid signature, want an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2005-2017 The Mumble Developers. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file at the root of the
+// Mumble source tree or at <https://www.mumble.info/LICENSE>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// distfileCheck is an archive in a distfiles directory to be
+// checked against its size and SHA-512 sum.
+type distfileCheck struct {
+	Name   string
+	Path   string
+	Size   int64
+	SHA512 string
+	Err    error
+}
+
+// loadDistfilesRepository verifies the signature of the setup.ini
+// of repo in the distfiles directory dir, and parses it. The
+// first setup.ini variant that has a signature is used; a plain
+// setup.ini without one is what was decompressed from another
+// variant.
+func loadDistfilesRepository(repo *Repository, dir string) (*Distribution, error) {
+	for _, variant := range setupIniVariants {
+		relativeUrl := Args.Arch + "/" + variant
+		absFn := filepath.Join(dir, filepath.FromSlash(repo.DistfileName(relativeUrl)))
+		if _, err := os.Stat(absFn); err != nil {
+			continue
+		}
+		if _, err := os.Stat(absFn + ".sig"); err != nil {
+			continue
+		}
+		repo.setFilePath(relativeUrl, absFn)
+		repo.setFilePath(relativeUrl+".sig", absFn+".sig")
+
+		err := verifySetupIniSignature(repo, relativeUrl)
+		if err != nil {
+			return nil, fmt.Errorf("unable to verify %v signature: %v", variant, err)
+		}
+
+		if variant != "setup.ini" {
+			tmp, err := ioutil.TempFile("", "setup.ini")
+			if err != nil {
+				return nil, err
+			}
+			tmp.Close()
+			defer os.Remove(tmp.Name())
+
+			err = decompressSetupIniVariant(absFn, tmp.Name())
+			if err != nil {
+				return nil, fmt.Errorf("unable to decompress %v: %v", variant, err)
+			}
+			repo.setFilePath(Args.Arch+"/setup.ini", tmp.Name())
+		}
+
+		return parseSetupIni(repo, Args.Arch+"/setup.ini")
+	}
+	return nil, fmt.Errorf("no signed %v setup.ini", Args.Arch)
+}
+
+// checkDistfiles checks the size and SHA-512 sum of checks in
+// parallel, and records the result in their Err fields.
+func checkDistfiles(checks []distfileCheck) {
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				checks[i].Err = checkSHA512(checks[i].Path, checks[i].Size, checks[i].SHA512)
+			}
+		}()
+	}
+	for i := range checks {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
+
+func runVerifyDistfiles(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expected at most one distfiles directory argument, got %v", len(args))
+	}
+	dir := Args.Distfiles()
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	repos, err := loadRepositories()
+	if err != nil {
+		return fmt.Errorf("unable to load repositories: %v", err)
+	}
+
+	report := &checkReport{}
+	dists := []*Distribution{}
+	referenced := make(map[string]bool)
+	checks := []distfileCheck{}
+	for _, repo := range repos {
+		dist, err := loadDistfilesRepository(repo, dir)
+		if err != nil {
+			return fmt.Errorf("repository '%v': %v", repo, err)
+		}
+		dists = append(dists, dist)
+
+		for _, pkg := range dist.Packages {
+			for _, section := range setupIniSections {
+				for _, field := range []string{"install", "source"} {
+					info, ok := pkg.Meta[section+field].([]string)
+					if !ok || len(info) != 3 {
+						continue
+					}
+					name := repo.DistfileName(info[0])
+					if referenced[name] {
+						continue
+					}
+					referenced[name] = true
+
+					absFn := filepath.Join(dir, filepath.FromSlash(name))
+					if _, err := os.Stat(absFn); err != nil {
+						continue
+					}
+					size, err := strconv.ParseInt(info[1], 10, 64)
+					if err != nil {
+						report.Errorf(name, "malformed size '%v' in setup.ini", info[1])
+						continue
+					}
+					checks = append(checks, distfileCheck{Name: name, Path: absFn, Size: size, SHA512: info[2]})
+				}
+			}
+		}
+	}
+
+	log.Printf("verifying %v archives", len(checks))
+	checkDistfiles(checks)
+	for _, check := range checks {
+		if check.Err != nil {
+			report.Errorf(check.Name, "corrupt: %v", check.Err)
+		}
+	}
+
+	dist, err := mergeDistributions(repos, dists)
+	if err != nil {
+		return err
+	}
+	pkgs, err := requestedPackages(dist)
+	if err != nil {
+		return err
+	}
+	closure, missing := resolveClosure(dist, pkgs, Args.Excludes())
+	for _, name := range missing {
+		report.Errorf(name, "no such package")
+	}
+	for _, name := range closure {
+		pkg, err := dist.Get(name)
+		if err != nil {
+			return err
+		}
+		relativeUrl, _, _ := pkg.InstallInfo()
+		if relativeUrl == "" {
+			continue
+		}
+		distfileName := pkg.Repo.DistfileName(relativeUrl)
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(distfileName))); err != nil {
+			report.Errorf(distfileName, "missing archive of package '%v'", name)
+		}
+	}
+
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := distfileArchiveURL(rel); (ok || strings.HasSuffix(rel, ".part")) && !referenced[rel] {
+			report.Errorf(rel, "unreferenced")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Package < report.Problems[j].Package
+	})
+	for _, problem := range report.Problems {
+		fmt.Printf("%v: %v: %v\n", problem.Severity, problem.Package, problem.Message)
+	}
+
+	if n := report.NumErrors(); n > 0 {
+		return fmt.Errorf("found %v problems in %v", n, dir)
+	}
+
+	log.Printf("all %v archives are intact", len(checks))
+	return nil
+}
@@ -7,3 +7,19 @@ package main
 
 var progName = "cygwin-bootstrap"
 var progVersion = "0.3"
+
+// setupIniFormatVersion is the newest setup.ini format, as a
+// setup.exe version, that cygwin-bootstrap understands.
+// setup.ini files with a newer setup-minimum-version are
+// refused, unless -ignore-minimum-version is given.
+//
+// It is the setup-minimum-version that calm, the tool that
+// generates setup.ini for the Cygwin mirrors, declares in the
+// header of the current x86_64/setup.ini. Of the format that
+// setup.exe reads at that version (see inilex.ll and
+// iniparse.yy in the cygwin-apps/setup repository),
+// cygwin-bootstrap needs the [prev] and [test] sections,
+// install lines with SHA-512 sums, and dependencies given via
+// requires or depends2; other fields, such as obsoletes and
+// provides, are preserved but ignored.
+var setupIniFormatVersion = "2.903"